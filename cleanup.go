@@ -0,0 +1,187 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// NewTTLMapWithContext is like NewTTLMap, but the background cleanup of
+// the returned map is stopped once ctx is done and can not be started
+// afterwards. No goroutine is started until the cleanup is.
+func NewTTLMapWithContext(ctx context.Context, capacity int, opts ...Option) *TTLMap {
+	m := NewTTLMap(capacity, opts...)
+	m.ctx = ctx
+	return m
+}
+
+// StartCleanup starts a background goroutine removing expired entries
+// every interval. It returns an error if the cleanup is already running.
+func (m *TTLMap) StartCleanup(interval time.Duration) error {
+	return m.StartCleanupJittered(interval, 0)
+}
+
+// StartCleanupJittered starts a background goroutine removing expired
+// entries, waiting a random interval within [base-jitter, base+jitter]
+// between sweeps so that many instances don't sweep at the same instant.
+// Jitter is capped below base so the interval is always positive.
+// It returns an error if the cleanup is already running.
+func (m *TTLMap) StartCleanupJittered(base time.Duration, jitter time.Duration) error {
+	m.cleanupMutex.Lock()
+	defer m.cleanupMutex.Unlock()
+
+	if m.ctx != nil && m.ctx.Err() != nil {
+		return m.ctx.Err()
+	}
+	if m.cleanupStop != nil {
+		return fmt.Errorf("cleanup is already running")
+	}
+	m.cleanupStop = make(chan struct{})
+	m.cleanupDone = make(chan struct{})
+	go m.cleanup(base, jitter, m.cleanupStop, m.cleanupDone)
+	return nil
+}
+
+// StartJanitor is the same as StartCleanup
+func (m *TTLMap) StartJanitor(interval time.Duration) error {
+	return m.StartCleanup(interval)
+}
+
+// StopJanitor is the same as StopCleanup
+func (m *TTLMap) StopJanitor() {
+	m.StopCleanup()
+}
+
+// CleanupRunning reports whether the background cleanup is running
+func (m *TTLMap) CleanupRunning() bool {
+	m.cleanupMutex.Lock()
+	defer m.cleanupMutex.Unlock()
+	return m.cleanupStop != nil && (m.ctx == nil || m.ctx.Err() == nil)
+}
+
+// StopCleanup stops the background cleanup goroutine and waits
+// for it to exit. It is a no-op if the cleanup is not running. If a sweep
+// is in progress, e.g. when called from a callback executed by the sweep,
+// it returns without waiting for the sweep to finish, no sweep is started
+// afterwards.
+func (m *TTLMap) StopCleanup() {
+	m.cleanupMutex.Lock()
+	stop, done, sweeping := m.cleanupStop, m.cleanupDone, m.cleanupSweeping
+	m.cleanupStop, m.cleanupDone, m.cleanupSweeping = nil, nil, false
+	m.cleanupMutex.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	if !sweeping {
+		<-done
+	}
+}
+
+// beginSweep marks the sweep of the cleanup started with stop as in
+// progress, it returns false if the cleanup has been stopped since
+func (m *TTLMap) beginSweep(stop chan struct{}) bool {
+	m.cleanupMutex.Lock()
+	defer m.cleanupMutex.Unlock()
+	if m.cleanupStop != stop {
+		return false
+	}
+	m.cleanupSweeping = true
+	return true
+}
+
+func (m *TTLMap) endSweep(stop chan struct{}) {
+	m.cleanupMutex.Lock()
+	defer m.cleanupMutex.Unlock()
+	if m.cleanupStop == stop {
+		m.cleanupSweeping = false
+	}
+}
+
+func (m *TTLMap) cleanup(base, jitter time.Duration, stop chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	var ctxDone <-chan struct{}
+	if m.ctx != nil {
+		ctxDone = m.ctx.Done()
+	}
+	for {
+		select {
+		case <-m.getClock().After(m.cleanupInterval(base, jitter)):
+			if !m.beginSweep(stop) {
+				return
+			}
+			m.lock()
+			m.removeExpired(len(m.elements))
+			m.unlock()
+			m.endSweep(stop)
+		case <-stop:
+			return
+		case <-ctxDone:
+			return
+		}
+	}
+}
+
+// sweepBatch is the number of expired entries removed by the
+// async sweeper before yielding the lock to other callers
+const sweepBatch = 100
+
+// WithAsyncSweeps removes expired entries in a background goroutine
+// rather than inline when an insert needs to free space. The goroutine is
+// started on demand and exits once all expired entries are removed.
+// Entries evicted to make room for the insert are still removed inline.
+func WithAsyncSweeps() Option {
+	return func(m *TTLMap) {
+		m.asyncSweeps = true
+	}
+}
+
+// signalSweep starts the async sweeper if it is not running,
+// must be called with the lock held
+func (m *TTLMap) signalSweep() {
+	if m.sweeping {
+		return
+	}
+	m.sweeping = true
+	go m.sweep()
+}
+
+func (m *TTLMap) sweep() {
+	for {
+		m.lock()
+		if m.removeExpired(sweepBatch) < sweepBatch {
+			m.sweeping = false
+			m.unlock()
+			return
+		}
+		m.unlock()
+	}
+}
+
+func (m *TTLMap) cleanupInterval(base, jitter time.Duration) time.Duration {
+	if jitter >= base {
+		jitter = base - 1
+	}
+	if jitter <= 0 {
+		return base
+	}
+	m.randMutex.Lock()
+	defer m.randMutex.Unlock()
+	return base - jitter + time.Duration(m.getRand().Int63n(int64(2*jitter)+1))
+}
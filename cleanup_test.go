@@ -0,0 +1,217 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestCleanupRemovesExpired() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock)
+
+	err := m.Set("a", 1, 1)
+	s.Require().Equal(nil, err)
+	err = m.Set("b", 2, 10)
+	s.Require().Equal(nil, err)
+
+	err = m.StartCleanup(time.Second)
+	s.Require().Equal(nil, err)
+	defer m.StopCleanup()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	// wait for the sweep to complete and the next tick to be scheduled
+	clock.BlockUntil(1)
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	s.Require().Equal(1, len(m.elements))
+	s.Require().NotNil(m.elements["b"])
+}
+
+func (s *TTLMapSuite) TestCleanupFiresOnExpire() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock)
+	expired := make(chan string, 1)
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired <- key
+	})
+	s.Require().Equal(nil, m.Set("a", 1, 1))
+
+	s.Require().Equal(nil, m.StartCleanup(time.Second))
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	s.Require().Equal("a", <-expired)
+
+	m.StopCleanup()
+	m.StopCleanup()
+	s.Require().Equal(0, m.Len())
+}
+
+func (s *TTLMapSuite) TestJanitor() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock)
+	expired := make(chan string, 1)
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired <- key
+	})
+	s.Require().Equal(nil, m.Set("a", 1, 1))
+
+	s.Require().Equal(nil, m.StartJanitor(time.Second))
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	s.Require().Equal("a", <-expired)
+
+	m.StopJanitor()
+	m.StopJanitor()
+	s.Require().Equal(false, m.CleanupRunning())
+}
+
+func (s *TTLMapSuite) TestCleanupStoppedFromCallback() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock)
+	stopped := make(chan bool, 1)
+	m.SetOnExpire(func(string, interface{}) {
+		m.StopCleanup()
+		stopped <- m.CleanupRunning()
+	})
+	s.Require().Equal(nil, m.Set("a", 1, 1))
+
+	s.Require().Equal(nil, m.StartCleanup(time.Second))
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	select {
+	case running := <-stopped:
+		s.Require().Equal(false, running)
+	case <-time.After(5 * time.Second):
+		s.FailNow("StopCleanup deadlocked in a callback")
+	}
+	m.StopCleanup()
+}
+
+func (s *TTLMapSuite) TestCleanupStopsWithContext() {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := clockwork.NewFakeClock()
+	m := NewTTLMapWithContext(ctx, 1)
+	m.clock = clock
+
+	s.Require().Equal(nil, m.StartCleanup(time.Second))
+	clock.BlockUntil(1)
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.Require().True(runtime.NumGoroutine() <= before, "goroutines leaked")
+	s.Require().Equal(false, m.CleanupRunning())
+	s.Require().Equal(context.Canceled, m.StartCleanup(time.Second))
+}
+
+func (s *TTLMapSuite) TestContextDoesNotLeakGoroutines() {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		NewTTLMapWithContext(context.Background(), 1)
+	}
+	s.Require().Equal(before, runtime.NumGoroutine())
+}
+
+func (s *TTLMapSuite) TestCleanupJitteredIntervals() {
+	m := NewTTLMap(1, WithRandSource(rand.NewSource(1)))
+
+	base, jitter := 10*time.Second, 2*time.Second
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		interval := m.cleanupInterval(base, jitter)
+		s.Require().True(interval >= base-jitter, "%v is below the bound", interval)
+		s.Require().True(interval <= base+jitter, "%v is above the bound", interval)
+		seen[interval] = true
+	}
+	s.Require().True(len(seen) > 1)
+
+	s.Require().Equal(base, m.cleanupInterval(base, 0))
+}
+
+func (s *TTLMapSuite) TestCleanupRunning() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1, clock)
+	s.Require().Equal(false, m.CleanupRunning())
+
+	err := m.StartCleanup(time.Second)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, m.CleanupRunning())
+
+	stop := m.cleanupStop
+	err = m.StartCleanupJittered(time.Second, time.Millisecond)
+	s.Require().EqualError(err, "cleanup is already running")
+	s.Require().Equal(stop, m.cleanupStop)
+
+	// only one goroutine is waiting on the clock
+	clock.BlockUntil(1)
+
+	m.StopCleanup()
+	s.Require().Equal(false, m.CleanupRunning())
+	m.StopCleanup()
+
+	err = m.StartCleanup(time.Second)
+	s.Require().Equal(nil, err)
+	m.StopCleanup()
+}
+
+func (s *TTLMapSuite) TestAsyncSweeps() {
+	clock := clockwork.NewFakeClock()
+	var calls int64
+	release := make(chan struct{})
+	m := newTTLMap(1000, clock, WithAsyncSweeps())
+	m.SetOnExpire(func(string, interface{}) {
+		// block the sweeper, only the entry evicted inline gets through
+		if atomic.AddInt64(&calls, 1) > 1 {
+			<-release
+		}
+	})
+
+	for i := 0; i < 1000; i++ {
+		err := m.Set(fmt.Sprint(i), i, 1)
+		s.Require().Equal(nil, err)
+	}
+	clock.Advance(1 * time.Second)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Set("new", 1, 10)
+	}()
+	select {
+	case err := <-done:
+		s.Require().Equal(nil, err)
+	case <-time.After(5 * time.Second):
+		s.FailNow("Set blocked on sweeping expired entries")
+	}
+
+	close(release)
+	s.Require().Eventually(func() bool {
+		return m.Len() == 1
+	}, 5*time.Second, time.Millisecond)
+	s.Require().Equal(int64(1000), atomic.LoadInt64(&calls))
+}
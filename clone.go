@@ -0,0 +1,80 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+// Clone returns an independent copy of the map holding its live entries
+// with their expiry times, tags, metadata and pins, and sharing its clock
+// and configuration. Callbacks, i.e. OnExpire, the WithOnEvict,
+// WithOnTTLExtended and WithOnOverCapacity callbacks, the expire sink and
+// the expire events channel, are not copied, neither are the stats.
+// Closers set with SetCloser stay owned by the original map.
+func (m *TTLMap) Clone() *TTLMap {
+	m.rLock()
+	defer m.rUnlock()
+
+	c := NewTTLMap(m.capacity)
+	c.clock = m.getClock()
+	c.maxCost = m.maxCost
+	c.coster = m.coster
+	c.ttlBucket = m.ttlBucket
+	c.ttlJitter = m.ttlJitter
+	c.equal = m.equal
+	c.serveStale = m.serveStale
+	c.earlyBeta = m.earlyBeta
+	c.compression = m.compression
+	c.maxValueSize = m.maxValueSize
+	c.sizer = m.sizer
+	c.asyncSweeps = m.asyncSweeps
+	c.softCapacity = m.softCapacity
+	c.tieBreaker = m.tieBreaker
+	c.policy = m.policy
+	c.lowWatermark = m.lowWatermark
+	c.sliding = m.sliding
+	c.defaultTTL = m.defaultTTL
+	c.allowNoExpiry = m.allowNoExpiry
+	c.copier = m.copier
+	c.expireRateLimit = m.expireRateLimit
+	c.contentionMetrics = m.contentionMetrics
+	for name, index := range m.indexes {
+		WithSecondaryIndex(name, index.derive)(c)
+	}
+
+	now := int(m.getClock().Now().Unix())
+	for _, mapEl := range m.liveElements(now) {
+		c.copyEntry(mapEl)
+	}
+	return c
+}
+
+// copyEntry stores a copy of the entry of another map configured the same
+// way along with its expiry time, tags, metadata and pin, it must be
+// called with the lock held
+func (m *TTLMap) copyEntry(mapEl *mapElement) error {
+	// Values are stored encoded the same way in both maps
+	if err := m.insert(mapEl.key, mapEl.value, mapEl.heapEl.Priority, mapEl.cost, true); err != nil {
+		return err
+	}
+	copied := m.elements[mapEl.key]
+	copied.ttl = mapEl.ttl
+	copied.meta = mapEl.meta
+	copied.weighted = mapEl.weighted
+	m.tag(copied, mapEl.tags)
+	if mapEl.pinned {
+		copied.pinned = true
+		m.pinnedCount += 1
+	}
+	return nil
+}
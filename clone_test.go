@@ -0,0 +1,56 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestClone() {
+	clock := clockwork.NewFakeClock()
+	var expired []string
+	m := newTTLMap(3, clock)
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired = append(expired, key)
+	})
+	m.Set("a", 1, 10)
+	m.SetWithTags("b", 2, 20, "group")
+	m.Set("c", 3, 1)
+	clock.Advance(time.Second)
+
+	c := m.Clone()
+	s.Require().Equal("ttlmap(len=2/cap=3){a=1(ttl=9s) b=2(ttl=19s)}", c.String())
+
+	m.Set("a", 10, 10)
+	m.Remove("b")
+	m.Set("d", 4, 10)
+	value, _ := c.Get("a")
+	s.Require().Equal(1, value)
+	_, exists := c.Get("b")
+	s.Require().Equal(true, exists)
+	_, exists = c.Get("d")
+	s.Require().Equal(false, exists)
+
+	s.Require().Equal(1, c.InvalidateTag("group"))
+	s.Require().Equal(1, c.Len())
+
+	expired = nil
+	clock.Advance(10 * time.Second)
+	c.RemoveExpired(10)
+	s.Require().Empty(expired)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"io"
+	"sync"
+)
+
+// closerRef tracks references to a value that has to be
+// closed once it is removed from the map
+type closerRef struct {
+	closer  io.Closer
+	refs    int
+	removed bool
+}
+
+// WithRefCounting defers closing values stored with SetCloser until
+// all references obtained with Acquire have been released
+func WithRefCounting() Option {
+	return func(m *TTLMap) {
+		m.refCounting = true
+	}
+}
+
+// SetCloser stores a value that is closed once it is removed from the map,
+// whether it has expired, was evicted or overwritten. Close is called once
+// the map lock is released and errors it returns are ignored.
+func (m *TTLMap) SetCloser(key string, value io.Closer, ttlSeconds int) error {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return err
+	}
+	m.lock()
+	defer m.unlock()
+
+	var ref *closerRef
+	// Storing the same value again must not close it
+	mapEl, reused := m.elements[key]
+	if reused && mapEl.closer != nil && mapEl.closer.closer == value {
+		ref = mapEl.closer
+		mapEl.closer = nil
+	} else {
+		reused = false
+		ref = &closerRef{closer: value}
+	}
+	if err := m.set(key, value, expiryTime); err != nil {
+		if reused && m.elements[key] == mapEl {
+			// the entry was kept, so is the reference taken from it
+			mapEl.closer = ref
+		}
+		return err
+	}
+	m.elements[key].closer = ref
+	return nil
+}
+
+// Acquire returns the value stored under key along with a function
+// releasing the reference. With WithRefCounting, values stored with
+// SetCloser are not closed until all references are released.
+func (m *TTLMap) Acquire(key string) (value interface{}, release func(), ok bool) {
+	m.lock()
+	defer m.unlock()
+
+	mapEl, expired := m.get(key)
+	if mapEl == nil || expired {
+		return nil, func() {}, false
+	}
+	value, ok = m.valueOf(mapEl)
+	if !ok {
+		return nil, func() {}, false
+	}
+	value = m.copyValue(value)
+	ref := mapEl.closer
+	if !m.refCounting || ref == nil {
+		return value, func() {}, true
+	}
+
+	ref.refs += 1
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			m.lock()
+			defer m.unlock()
+			ref.refs -= 1
+			if ref.removed && ref.refs == 0 {
+				m.deferUnlock(func() {
+					ref.closer.Close()
+				})
+			}
+		})
+	}
+	return value, release, true
+}
+
+// releaseCloser marks the value as removed and closes it once the map lock
+// is released, unless references to it are still held
+func (m *TTLMap) releaseCloser(ref *closerRef) {
+	ref.removed = true
+	if ref.refs == 0 {
+		m.deferUnlock(func() {
+			ref.closer.Close()
+		})
+	}
+}
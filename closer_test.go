@@ -0,0 +1,114 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+type testCloser struct {
+	closed int
+}
+
+func (c *testCloser) Close() error {
+	c.closed += 1
+	return nil
+}
+
+func (s *TTLMapSuite) TestCloseOnExpiry() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock)
+
+	c := &testCloser{}
+	err := m.SetCloser("a", c, 1)
+	s.Require().Equal(nil, err)
+
+	err = m.SetCloser("a", c, 2)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(0, c.closed)
+
+	clock.Advance(2 * time.Second)
+
+	_, exists := m.Get("a")
+	s.Require().Equal(false, exists)
+	s.Require().Equal(1, c.closed)
+}
+
+func (s *TTLMapSuite) TestCloseOnOverwrite() {
+	m := NewTTLMap(2)
+
+	c := &testCloser{}
+	err := m.SetCloser("a", c, 10)
+	s.Require().Equal(nil, err)
+
+	err = m.Set("a", 1, 10)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(1, c.closed)
+}
+
+func (s *TTLMapSuite) TestDeferredCloseWithOutstandingRefs() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock, WithRefCounting())
+
+	c := &testCloser{}
+	err := m.SetCloser("a", c, 1)
+	s.Require().Equal(nil, err)
+
+	valI, release, exists := m.Acquire("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(c, valI)
+
+	clock.Advance(1 * time.Second)
+	s.Require().Equal(1, m.RemoveExpired(10))
+	s.Require().Equal(0, c.closed)
+
+	release()
+	s.Require().Equal(1, c.closed)
+
+	release()
+	s.Require().Equal(1, c.closed)
+}
+
+// mapCloser accesses the map when closed
+type mapCloser struct {
+	m       *TTLMap
+	lenSeen int
+}
+
+func (c *mapCloser) Close() error {
+	c.lenSeen = c.m.Len()
+	return nil
+}
+
+func (s *TTLMapSuite) TestCloseOutsideLock() {
+	m := newTTLMap(2, clockwork.NewFakeClock(), WithRefCounting())
+	c := &mapCloser{m: m, lenSeen: -1}
+	s.Require().Equal(nil, m.SetCloser("a", c, 10))
+	m.Set("b", 2, 10)
+
+	_, release, _ := m.Acquire("a")
+	m.Remove("a")
+	s.Require().Equal(-1, c.lenSeen)
+	release()
+	s.Require().Equal(1, c.lenSeen)
+
+	c = &mapCloser{m: m, lenSeen: -1}
+	s.Require().Equal(nil, m.SetCloser("a", c, 10))
+	s.Require().Equal(nil, m.Set("a", 1, 10))
+	s.Require().Equal(2, c.lenSeen)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// Codec compresses and decompresses values stored in the map
+type Codec interface {
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// GzipCodec is a Codec using gzip compression
+type GzipCodec struct{}
+
+func (GzipCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCodec) Decode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type compression struct {
+	threshold int
+	codec     Codec
+}
+
+// compressedValue is a []byte or string value stored compressed
+type compressedValue struct {
+	data     []byte
+	isString bool
+}
+
+// WithValueCompression transparently compresses []byte and string values
+// larger than threshold bytes using codec. Smaller values and values of
+// other types are stored as is. Values codec fails to decode are reported
+// with WithOnError and treated as missing.
+func WithValueCompression(threshold int, codec Codec) Option {
+	return func(m *TTLMap) {
+		m.compression = &compression{threshold: threshold, codec: codec}
+	}
+}
+
+func (m *TTLMap) encodeValue(value interface{}) (interface{}, error) {
+	if m.compression == nil {
+		return value, nil
+	}
+	var data []byte
+	isString := false
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+		isString = true
+	default:
+		return value, nil
+	}
+	if len(data) <= m.compression.threshold {
+		return value, nil
+	}
+	compressed, err := m.compression.codec.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+	return compressedValue{data: compressed, isString: isString}, nil
+}
+
+// decodeValue returns the value of the entry as it was stored by the
+// caller, decompressing it if needed
+func (m *TTLMap) decodeValue(mapEl *mapElement) (interface{}, error) {
+	compressed, ok := mapEl.value.(compressedValue)
+	if !ok {
+		return mapEl.value, nil
+	}
+	data, err := m.compression.codec.Decode(compressed.data)
+	if err != nil {
+		return nil, wrapf(err, "failed to decode value of %q: %v", mapEl.key, err)
+	}
+	if compressed.isString {
+		return string(data), nil
+	}
+	return data, nil
+}
+
+// valueOf is like decodeValue but reports the error with WithOnError
+// once the map lock is released, it must be called with the lock held
+func (m *TTLMap) valueOf(mapEl *mapElement) (interface{}, bool) {
+	value, err := m.decodeValue(mapEl)
+	if err != nil {
+		m.reportError(err)
+		return nil, false
+	}
+	return value, true
+}
+
+// notifyErrors passes the errors to the WithOnError callback, readers
+// collect them under the read lock and call it once the lock is released
+func (m *TTLMap) notifyErrors(errs ...error) {
+	if m.onError == nil {
+		return
+	}
+	for _, err := range errs {
+		if err != nil {
+			m.onError(err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+func (s *TTLMapSuite) TestValueCompression() {
+	m := NewTTLMap(4, WithValueCompression(16, GzipCodec{}))
+
+	large := strings.Repeat("banana", 100)
+	err := m.Set("string", large, 10)
+	s.Require().Equal(nil, err)
+
+	err = m.Set("bytes", bytes.Repeat([]byte("a"), 100), 10)
+	s.Require().Equal(nil, err)
+
+	err = m.Set("small", "banana", 10)
+	s.Require().Equal(nil, err)
+
+	err = m.Set("int", 42, 10)
+	s.Require().Equal(nil, err)
+
+	compressed, ok := m.elements["string"].value.(compressedValue)
+	s.Require().Equal(true, ok)
+	s.Require().True(len(compressed.data) < len(large))
+	s.Require().IsType(compressedValue{}, m.elements["bytes"].value)
+	s.Require().Equal("banana", m.elements["small"].value)
+	s.Require().Equal(42, m.elements["int"].value)
+
+	valI, exists := m.Get("string")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(large, valI)
+
+	valI, exists = m.Get("bytes")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(bytes.Repeat([]byte("a"), 100), valI)
+
+	valI, exists = m.Get("small")
+	s.Require().Equal(true, exists)
+	s.Require().Equal("banana", valI)
+}
+
+func (s *TTLMapSuite) TestValueCompressionAcquire() {
+	m := NewTTLMap(1, WithValueCompression(16, GzipCodec{}))
+	large := strings.Repeat("banana", 100)
+	s.Require().Equal(nil, m.Set("a", large, 10))
+
+	value, release, ok := m.Acquire("a")
+	defer release()
+	s.Require().Equal(true, ok)
+	s.Require().Equal(large, value)
+}
+
+// countingCodec counts the values it decompresses
+type countingCodec struct {
+	GzipCodec
+	decoded *int
+}
+
+func (c countingCodec) Decode(data []byte) ([]byte, error) {
+	*c.decoded += 1
+	return c.GzipCodec.Decode(data)
+}
+
+func (s *TTLMapSuite) TestValueCompressionTieBreaker() {
+	decoded := 0
+	var values []interface{}
+	m := NewTTLMap(3, WithValueCompression(16, countingCodec{decoded: &decoded}),
+		WithEvictionTieBreaker(func(a, b Entry) bool {
+			values = append(values, a.Value, b.Value)
+			return a.Key > b.Key
+		}))
+	for _, key := range []string{"a", "b", "c", "d"} {
+		s.Require().Equal(nil, m.Set(key, strings.Repeat(key, 100), 10))
+	}
+	s.Require().Equal(0, decoded)
+	s.Require().NotEmpty(values)
+	for _, value := range values {
+		s.Require().Equal(nil, value)
+	}
+	s.Require().Equal(map[string]bool{"a": true, "b": true, "c": false, "d": true},
+		m.ContainsAll([]string{"a", "b", "c", "d"}))
+}
+
+// brokenCodec compresses values but fails to decompress them
+type brokenCodec struct{ GzipCodec }
+
+func (brokenCodec) Decode([]byte) ([]byte, error) {
+	return nil, errors.New("corrupt")
+}
+
+func (s *TTLMapSuite) TestValueCompressionDecodeError() {
+	var errs []error
+	m := NewTTLMap(1, WithValueCompression(16, brokenCodec{}), WithOnError(func(err error) {
+		errs = append(errs, err)
+	}))
+	s.Require().Equal(nil, m.Set("a", strings.Repeat("banana", 100), 10))
+
+	value, ok := m.Get("a")
+	s.Require().Equal(false, ok)
+	s.Require().Equal(nil, value)
+	_, _, ok = m.Acquire("a")
+	s.Require().Equal(false, ok)
+	s.Require().Equal(0, len(m.Dump()))
+
+	s.Require().Equal(3, len(errs))
+	s.Require().EqualError(errs[0], `failed to decode value of "a": corrupt`)
+}
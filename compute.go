@@ -0,0 +1,83 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"fmt"
+)
+
+// load is a call to a GetOrCompute loader other callers wait for
+type load struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// GetOrCompute returns the value of the live entry stored under key,
+// otherwise it stores and returns the value returned by loader. Concurrent
+// callers missing the same key wait for the first one to load the value
+// instead of calling loader themselves. If loader returns an error nothing
+// is stored and the error is returned to all of them. Entries missed
+// early with WithProbabilisticEarlyExpiry are loaded again, as are stale
+// entries served with WithServeStaleUntilWrite.
+func (m *TTLMap) GetOrCompute(key string, ttlSeconds int, loader func() (interface{}, error)) (interface{}, error) {
+	if _, err := m.toEpochSeconds(ttlSeconds); err != nil {
+		return nil, err
+	}
+	if value, fresh, _ := m.GetFresh(key); fresh {
+		return value, nil
+	}
+
+	m.loadsMutex.Lock()
+	if l, ok := m.loads[key]; ok {
+		m.loadsMutex.Unlock()
+		<-l.done
+		return l.value, l.err
+	}
+	l := &load{
+		done: make(chan struct{}),
+		err:  fmt.Errorf("loader for %q panicked", key),
+	}
+	if m.loads == nil {
+		m.loads = make(map[string]*load)
+	}
+	m.loads[key] = l
+	m.loadsMutex.Unlock()
+
+	defer func() {
+		m.loadsMutex.Lock()
+		delete(m.loads, key)
+		m.loadsMutex.Unlock()
+		close(l.done)
+	}()
+
+	// The value could have been stored by a load that completed after
+	// the lookup above, it is subject to early expiry as with Get
+	if value, mapEl, expired, err := m.lockNGet(key); mapEl != nil && !expired && err == nil {
+		value = m.copyValue(value)
+		l.value, l.err = value, nil
+		return value, nil
+	}
+	value, err := loader()
+	if err == nil {
+		err = m.Set(key, value, ttlSeconds)
+	}
+	if err != nil {
+		value = nil
+	}
+	l.value, l.err = value, err
+	return value, err
+}
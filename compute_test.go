@@ -0,0 +1,105 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestGetOrCompute() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+
+	var calls int64
+	release := make(chan struct{})
+	loader := func() (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		return "loaded", nil
+	}
+
+	const callers = 50
+	var wg sync.WaitGroup
+	values := make([]interface{}, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values[i], errs[i] = m.GetOrCompute("a", 5, loader)
+		}(i)
+	}
+	s.Require().Eventually(func() bool {
+		return atomic.LoadInt64(&calls) == 1
+	}, 5*time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	s.Require().Equal(int64(1), atomic.LoadInt64(&calls))
+	for i := 0; i < callers; i++ {
+		s.Require().Equal(nil, errs[i])
+		s.Require().Equal("loaded", values[i])
+	}
+	value, exists := m.Get("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal("loaded", value)
+
+	clock.Advance(5 * time.Second)
+	value, err := m.GetOrCompute("a", 5, func() (interface{}, error) {
+		return "reloaded", nil
+	})
+	s.Require().Equal(nil, err)
+	s.Require().Equal("reloaded", value)
+}
+
+func (s *TTLMapSuite) TestGetOrComputeError() {
+	m := newTTLMap(10, clockwork.NewFakeClock())
+
+	loadErr := errors.New("load failed")
+	_, err := m.GetOrCompute("a", 5, func() (interface{}, error) {
+		return nil, loadErr
+	})
+	s.Require().Equal(loadErr, err)
+	s.Require().Equal(0, m.RawLen())
+
+	_, err = m.GetOrCompute("a", -1, func() (interface{}, error) {
+		s.FailNow("loader called with an invalid TTL")
+		return nil, nil
+	})
+	s.Require().True(errors.Is(err, ErrInvalidTTL))
+}
+
+func (s *TTLMapSuite) TestGetOrComputeEarlyExpiry() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1, clock, WithProbabilisticEarlyExpiry(10), WithRandSource(rand.NewSource(1)))
+	s.Require().Equal(nil, m.Set("a", 1, 100))
+	clock.Advance(99 * time.Second)
+
+	calls := 0
+	value, err := m.GetOrCompute("a", 100, func() (interface{}, error) {
+		calls += 1
+		return 2, nil
+	})
+	s.Require().Equal(nil, err)
+	s.Require().Equal(2, value)
+	s.Require().Equal(1, calls)
+}
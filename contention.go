@@ -0,0 +1,68 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// WithContentionMetrics measures how long operations wait to acquire the
+// map lock and reports it in Stats as AvgLockWait and MaxLockWait. Waits
+// are measured with the map clock, which adds overhead to every operation.
+func WithContentionMetrics() Option {
+	return func(m *TTLMap) {
+		m.contentionMetrics = true
+	}
+}
+
+// lock acquires the map lock for writing
+func (m *TTLMap) lock() {
+	if !m.contentionMetrics {
+		m.mutex.Lock()
+		return
+	}
+	start := m.getClock().Now()
+	m.mutex.Lock()
+	m.stats.countLockWait(m.getClock().Now().Sub(start))
+}
+
+// rLock acquires the map lock for reading
+func (m *TTLMap) rLock() {
+	if !m.contentionMetrics {
+		m.mutex.RLock()
+		return
+	}
+	start := m.getClock().Now()
+	m.mutex.RLock()
+	m.stats.countLockWait(m.getClock().Now().Sub(start))
+}
+
+// rUnlock releases the map lock acquired by rLock
+func (m *TTLMap) rUnlock() {
+	m.mutex.RUnlock()
+}
+
+func (c *counters) countLockWait(wait time.Duration) {
+	atomic.AddInt64(&c.lockWaits, 1)
+	atomic.AddInt64(&c.lockWaitTotal, int64(wait))
+	for {
+		max := atomic.LoadInt64(&c.lockWaitMax)
+		if int64(wait) <= max || atomic.CompareAndSwapInt64(&c.lockWaitMax, max, int64(wait)) {
+			return
+		}
+	}
+}
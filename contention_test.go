@@ -0,0 +1,48 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+func (s *TTLMapSuite) TestContentionMetrics() {
+	m := NewTTLMap(100, WithContentionMetrics())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := fmt.Sprintf("%d", (i+j)%10)
+				m.Set(key, j, 10)
+				m.Get(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := m.Stats()
+	s.Require().True(stats.AvgLockWait > 0)
+	s.Require().True(stats.MaxLockWait >= stats.AvgLockWait)
+
+	plain := NewTTLMap(1)
+	plain.Set("a", 1, 10)
+	s.Require().Equal(time.Duration(0), plain.Stats().MaxLockWait)
+}
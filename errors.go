@@ -0,0 +1,46 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidTTL is wrapped by errors returned for TTLs and
+	// expiry times that are not in the future
+	ErrInvalidTTL = errors.New("invalid TTL")
+	// ErrWrongType is wrapped by errors returned when an existing value
+	// is not of the type the operation expects
+	ErrWrongType = errors.New("wrong value type")
+)
+
+// wrappedError wraps a sentinel error keeping its own message,
+// so that errors.Is matches the sentinel
+type wrappedError struct {
+	message string
+	err     error
+}
+
+func (e *wrappedError) Error() string { return e.message }
+
+func (e *wrappedError) Unwrap() error { return e.err }
+
+// wrapf returns an error with the formatted message wrapping err
+func wrapf(err error, format string, args ...interface{}) error {
+	return &wrappedError{message: fmt.Sprintf(format, args...), err: err}
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"errors"
+	"time"
+)
+
+func (s *TTLMapSuite) TestErrorSentinels() {
+	m := NewTTLMap(10)
+
+	err := m.Set("a", 1, -1)
+	s.Require().True(errors.Is(err, ErrInvalidTTL))
+	s.Require().EqualError(err, "ttlSeconds should be >= 0, got -1")
+	_, err = m.Increment("a", 1, 0)
+	s.Require().True(errors.Is(err, ErrInvalidTTL))
+	err = m.SetExpireAt("a", 1, time.Now().Add(-time.Second))
+	s.Require().True(errors.Is(err, ErrInvalidTTL))
+
+	m.Set("s", "string", 10)
+	_, err = m.Increment("s", 1, 10)
+	s.Require().True(errors.Is(err, ErrWrongType))
+	s.Require().EqualError(err, "Expected existing value to be integer, got string")
+	_, _, err = m.GetInt("s")
+	s.Require().True(errors.Is(err, ErrWrongType))
+	_, _, err = GetAs[float64](m, "s")
+	s.Require().True(errors.Is(err, ErrWrongType))
+	s.Require().False(errors.Is(err, ErrInvalidTTL))
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+// ExpireEvent describes an entry removed from the map
+type ExpireEvent struct {
+	Key    string
+	Value  interface{}
+	Reason Reason
+}
+
+// WithExpireEvents makes the map send an event for every removed entry
+// on the channel returned by ExpireChan, buffering up to bufferSize
+// events. Events are sent without blocking, so events that don't fit
+// into the buffer because the consumer falls behind are dropped.
+func WithExpireEvents(bufferSize int) Option {
+	return func(m *TTLMap) {
+		m.expireEvents = make(chan ExpireEvent, bufferSize)
+	}
+}
+
+// ExpireChan returns the channel removal events are sent on, which is
+// nil unless the map was created WithExpireEvents
+func (m *TTLMap) ExpireChan() <-chan ExpireEvent {
+	return m.expireEvents
+}
+
+// sendExpireEvent sends the event unless the channel buffer is full
+func (m *TTLMap) sendExpireEvent(event ExpireEvent) {
+	select {
+	case m.expireEvents <- event:
+	default:
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestExpireEvents() {
+	s.Require().Nil(NewTTLMap(1).ExpireChan())
+
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock, WithExpireEvents(1))
+	m.Set("a", 1, 1)
+	m.Set("b", 2, 1)
+	clock.Advance(time.Second)
+	s.Require().Equal(2, m.RemoveExpired(10))
+
+	s.Require().Equal(ExpireEvent{Key: "a", Value: 1, Reason: ReasonExpired}, <-m.ExpireChan())
+	select {
+	case event := <-m.ExpireChan():
+		s.Fail("unexpected event", "%v", event)
+	default:
+	}
+
+	m.Set("c", 3, 10)
+	m.Remove("c")
+	s.Require().Equal(ExpireEvent{Key: "c", Value: 3, Reason: ReasonDeleted}, <-m.ExpireChan())
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// GetAs returns the value stored under key asserted to type T,
+// it errors if the value is of a different type
+func GetAs[T any](m *TTLMap, key string) (T, bool, error) {
+	var zero T
+	valueI, exists := m.Get(key)
+	if !exists {
+		return zero, false, nil
+	}
+	value, ok := valueI.(T)
+	if !ok {
+		return zero, false, wrapf(ErrWrongType, "Expected existing value to be %v, got %T",
+			reflect.TypeOf((*T)(nil)).Elem(), valueI)
+	}
+	return value, true, nil
+}
+
+// IncrementInt64 is like Increment for int64 counters,
+// it also reports whether the counter existed
+func (m *TTLMap) IncrementInt64(key string, value int64, ttlSeconds int) (int64, bool, error) {
+	return incrementNumber(m, key, value, ttlSeconds)
+}
+
+// IncrementFloat64 is like Increment for float64 counters,
+// it also reports whether the counter existed
+func (m *TTLMap) IncrementFloat64(key string, value float64, ttlSeconds int) (float64, bool, error) {
+	return incrementNumber(m, key, value, ttlSeconds)
+}
+
+// GetInt64 is like GetInt for int64 values
+func (m *TTLMap) GetInt64(key string) (int64, bool, error) {
+	return GetAs[int64](m, key)
+}
+
+// GetFloat64 is like GetInt for float64 values
+func (m *TTLMap) GetFloat64(key string) (float64, bool, error) {
+	return GetAs[float64](m, key)
+}
+
+func incrementNumber[T int64 | float64](m *TTLMap, key string, value T, ttlSeconds int) (T, bool, error) {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return 0, false, err
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	var currentValue T
+	mapEl, expired := m.get(key)
+	existed := mapEl != nil && !expired
+	if existed {
+		var ok bool
+		currentValue, ok = mapEl.value.(T)
+		if !ok {
+			current, _ := m.decodeValue(mapEl)
+			return 0, false, wrapf(ErrWrongType, "Expected existing value to be %v, got %T",
+				reflect.TypeOf(currentValue), current)
+		}
+	}
+
+	currentValue += value
+	if err := m.checkValueSize(currentValue); err != nil {
+		return 0, false, err
+	}
+	if err := m.set(key, currentValue, expiryTime); err != nil {
+		return 0, false, err
+	}
+	return currentValue, existed, nil
+}
+
+// Map is a TTLMap with keys of type K and values of type V
+type Map[K comparable, V any] struct {
+	m *TTLMap
+
+	// mutex guards ids and expired, it is held during every call to m
+	// that may remove entries, so that the removals reported to
+	// onRemove are delivered while it is held
+	mutex sync.Mutex
+	// entries are stored in m under ids assigned to keys, keys other
+	// than strings can not be converted to strings keeping == semantics
+	ids    map[K]string
+	nextID uint64
+	// removed entries OnExpire is executed for once mutex is released
+	expired  []mapEntry[K, V]
+	onExpire func(key K, value V)
+}
+
+// mapEntry keeps the typed key along with the value,
+// so that callbacks get the key as is
+type mapEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// New returns a Map holding up to capacity entries,
+// it shares eviction and expiration with TTLMap
+func New[K comparable, V any](capacity int) *Map[K, V] {
+	m := &Map[K, V]{ids: make(map[K]string)}
+	m.m = NewTTLMap(capacity, WithOnEvict(m.onRemove))
+	return m
+}
+
+// SetOnExpire sets the callback executed when an entry has expired
+func (m *Map[K, V]) SetOnExpire(f func(key K, value V)) {
+	m.mutex.Lock()
+	defer m.unlock()
+	m.onExpire = f
+}
+
+func (m *Map[K, V]) Set(key K, value V, ttlSeconds int) error {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	id, ok := m.idOf(key)
+	if !ok {
+		m.nextID += 1
+		id = strconv.FormatUint(m.nextID, 36)
+	}
+	if err := m.m.Set(id, mapEntry[K, V]{key: key, value: value}, ttlSeconds); err != nil {
+		return err
+	}
+	if !ok && !isString(key) {
+		m.ids[key] = id
+	}
+	return nil
+}
+
+func (m *Map[K, V]) Get(key K) (V, bool) {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	var zero V
+	id, ok := m.idOf(key)
+	if !ok {
+		return zero, false
+	}
+	value, exists := m.m.Get(id)
+	if !exists {
+		return zero, false
+	}
+	return value.(mapEntry[K, V]).value, true
+}
+
+func (m *Map[K, V]) Len() int {
+	return m.m.Len()
+}
+
+func (m *Map[K, V]) RemoveExpired(iterations int) int {
+	m.mutex.Lock()
+	defer m.unlock()
+	return m.m.RemoveExpired(iterations)
+}
+
+func (m *Map[K, V]) RemoveLastUsed(iterations int) {
+	m.mutex.Lock()
+	defer m.unlock()
+	m.m.RemoveLastUsed(iterations)
+}
+
+// idOf returns the id the entry stored under key is stored under in m,
+// string keys are used as is
+func (m *Map[K, V]) idOf(key K) (string, bool) {
+	if s, ok := any(key).(string); ok {
+		return s, true
+	}
+	id, ok := m.ids[key]
+	return id, ok
+}
+
+// onRemove forgets the id of the removed entry, it is executed by m
+// while mutex is held, see mutex
+func (m *Map[K, V]) onRemove(id string, value interface{}, reason Reason) {
+	entry := value.(mapEntry[K, V])
+	if !isString(entry.key) && m.ids[entry.key] == id {
+		delete(m.ids, entry.key)
+	}
+	if reason == ReasonExpired && m.onExpire != nil {
+		m.expired = append(m.expired, entry)
+	}
+}
+
+// unlock releases mutex and executes OnExpire for the expired entries
+func (m *Map[K, V]) unlock() {
+	expired, onExpire := m.expired, m.onExpire
+	m.expired = nil
+	m.mutex.Unlock()
+
+	for _, entry := range expired {
+		onExpire(entry.key, entry.value)
+	}
+}
+
+func isString[K comparable](key K) bool {
+	_, ok := any(key).(string)
+	return ok
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"math"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+type getAsValue struct {
+	Name string
+}
+
+func (s *TTLMapSuite) TestGetAs() {
+	m := NewTTLMap(3)
+	m.Set("int", 1, 10)
+	m.Set("string", "banana", 10)
+	m.Set("struct", getAsValue{Name: "kiwi"}, 10)
+
+	i, exists, err := GetAs[int](m, "int")
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, exists)
+	s.Require().Equal(1, i)
+
+	str, exists, err := GetAs[string](m, "string")
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, exists)
+	s.Require().Equal("banana", str)
+
+	v, exists, err := GetAs[getAsValue](m, "struct")
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, exists)
+	s.Require().Equal(getAsValue{Name: "kiwi"}, v)
+
+	_, exists, err = GetAs[int](m, "missing")
+	s.Require().Equal(nil, err)
+	s.Require().Equal(false, exists)
+
+	_, _, err = GetAs[int](m, "string")
+	s.Require().EqualError(err, "Expected existing value to be int, got string")
+
+	_, _, err = GetAs[getAsValue](m, "int")
+	s.Require().EqualError(err, "Expected existing value to be ttlmap.getAsValue, got int")
+}
+
+func (s *TTLMapSuite) TestIncrementInt64() {
+	m := NewTTLMap(10)
+
+	count, existed, err := m.IncrementInt64("bytes", math.MaxInt32, 10)
+	s.Require().NoError(err)
+	s.Require().Equal(false, existed)
+	count, existed, err = m.IncrementInt64("bytes", math.MaxInt32, 10)
+	s.Require().NoError(err)
+	s.Require().Equal(true, existed)
+	s.Require().Equal(int64(2*math.MaxInt32), count)
+
+	value, exists, err := m.GetInt64("bytes")
+	s.Require().NoError(err)
+	s.Require().Equal(true, exists)
+	s.Require().Equal(int64(2*math.MaxInt32), value)
+
+	m.Increment("int", 1, 10)
+	_, _, err = m.IncrementInt64("int", 1, 10)
+	s.Require().EqualError(err, "Expected existing value to be int64, got int")
+	_, _, err = m.GetInt64("int")
+	s.Require().EqualError(err, "Expected existing value to be int64, got int")
+	_, err = m.Increment("bytes", 1, 10)
+	s.Require().EqualError(err, "Expected existing value to be integer, got int64")
+}
+
+func (s *TTLMapSuite) TestIncrementFloat64() {
+	m := NewTTLMap(10)
+
+	m.IncrementFloat64("ratio", 0.25, 10)
+	sum, existed, err := m.IncrementFloat64("ratio", 0.5, 10)
+	s.Require().NoError(err)
+	s.Require().Equal(true, existed)
+	s.Require().Equal(0.75, sum)
+
+	value, exists, err := m.GetFloat64("ratio")
+	s.Require().NoError(err)
+	s.Require().Equal(true, exists)
+	s.Require().Equal(0.75, value)
+
+	_, _, err = m.IncrementInt64("ratio", 1, 10)
+	s.Require().EqualError(err, "Expected existing value to be int64, got float64")
+	_, _, err = m.IncrementFloat64("ratio", 1, 0)
+	s.Require().Error(err)
+}
+
+func (s *TTLMapSuite) TestMapStringInt() {
+	clock := clockwork.NewFakeClock()
+	m := New[string, int](2)
+	m.m.clock = clock
+	expired := make(map[string]int)
+	m.SetOnExpire(func(key string, value int) {
+		expired[key] = value
+	})
+
+	s.Require().Equal(nil, m.Set("a", 1, 1))
+	s.Require().Equal(nil, m.Set("b", 2, 10))
+	value, exists := m.Get("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(1, value)
+
+	clock.Advance(time.Second)
+	_, exists = m.Get("a")
+	s.Require().Equal(false, exists)
+	s.Require().Equal(map[string]int{"a": 1}, expired)
+
+	m.Set("c", 3, 20)
+	m.Set("d", 4, 20)
+	s.Require().Equal(2, m.Len())
+	_, exists = m.Get("b")
+	s.Require().Equal(false, exists)
+}
+
+func (s *TTLMapSuite) TestMapIntBytes() {
+	clock := clockwork.NewFakeClock()
+	m := New[int, []byte](10)
+	m.m.clock = clock
+	var expiredKeys []int
+	m.SetOnExpire(func(key int, value []byte) {
+		expiredKeys = append(expiredKeys, key)
+	})
+
+	m.Set(1, []byte("one"), 1)
+	m.Set(10, []byte("ten"), 10)
+	value, exists := m.Get(1)
+	s.Require().Equal(true, exists)
+	s.Require().Equal([]byte("one"), value)
+	_, exists = m.Get(2)
+	s.Require().Equal(false, exists)
+
+	clock.Advance(time.Second)
+	s.Require().Equal(1, m.RemoveExpired(10))
+	s.Require().Equal([]int{1}, expiredKeys)
+	s.Require().Equal(1, m.Len())
+}
+
+func (s *TTLMapSuite) TestMapPointerKeys() {
+	type key struct{ id int }
+	clock := clockwork.NewFakeClock()
+	m := New[*key, string](10)
+	m.m.clock = clock
+	var expiredKeys []*key
+	m.SetOnExpire(func(k *key, _ string) {
+		expiredKeys = append(expiredKeys, k)
+		// OnExpire can use the map
+		m.Len()
+	})
+
+	a, b := &key{1}, &key{1}
+	s.Require().Equal(nil, m.Set(a, "a", 1))
+	s.Require().Equal(nil, m.Set(b, "b", 10))
+	s.Require().Equal(2, m.Len())
+	value, _ := m.Get(a)
+	s.Require().Equal("a", value)
+
+	a.id = 2
+	value, exists := m.Get(a)
+	s.Require().Equal(true, exists)
+	s.Require().Equal("a", value)
+
+	clock.Advance(time.Second)
+	_, exists = m.Get(a)
+	s.Require().Equal(false, exists)
+	s.Require().Equal([]*key{a}, expiredKeys)
+	s.Require().Len(m.ids, 1)
+	value, _ = m.Get(b)
+	s.Require().Equal("b", value)
+}
+
+func (s *TTLMapSuite) TestMapFloatKeys() {
+	m := New[float64, int](10)
+	negativeZero := math.Copysign(0, -1)
+	s.Require().Equal(nil, m.Set(0.0, 1, 10))
+	s.Require().Equal(nil, m.Set(negativeZero, 2, 10))
+	s.Require().Equal(1, m.Len())
+	value, _ := m.Get(0.0)
+	s.Require().Equal(2, value)
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+// Idempotency records request IDs in a TTLMap to detect replays
+type Idempotency struct {
+	m *TTLMap
+}
+
+// NewIdempotency returns an Idempotency recording request IDs in m
+func NewIdempotency(m *TTLMap) *Idempotency {
+	return &Idempotency{m: m}
+}
+
+// Seen records the request ID for ttlSeconds and reports whether it had
+// already been recorded. Of many concurrent calls with the same ID only
+// one returns false. If ttlSeconds is invalid or the ID can not be
+// stored, e.g. because the map is full, Seen returns the error, in which
+// case the caller can not tell whether the request is a replay.
+func (i *Idempotency) Seen(requestID string, ttlSeconds int) (bool, error) {
+	expiryTime, err := i.m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return false, err
+	}
+
+	i.m.lock()
+	defer i.m.unlock()
+	stored, err := i.m.setIfAbsent(requestID, struct{}{}, expiryTime)
+	if err != nil {
+		return false, err
+	}
+	return !stored, nil
+}
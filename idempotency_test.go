@@ -0,0 +1,78 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestIdempotencySeen() {
+	clock := clockwork.NewFakeClock()
+	idem := NewIdempotency(newTTLMap(10, clock))
+
+	s.Require().Equal(false, s.seen(idem, "req-1", 10))
+	s.Require().Equal(true, s.seen(idem, "req-1", 10))
+	s.Require().Equal(false, s.seen(idem, "req-2", 10))
+	_, err := idem.Seen("req-3", 0)
+	s.Require().True(errors.Is(err, ErrInvalidTTL))
+	s.Require().Equal(false, s.seen(idem, "req-3", 1))
+
+	clock.Advance(10 * time.Second)
+	s.Require().Equal(false, s.seen(idem, "req-1", 10))
+}
+
+func (s *TTLMapSuite) TestIdempotencySeenFull() {
+	m := newTTLMap(1, clockwork.NewFakeClock())
+	m.Set("pinned", 1, 10)
+	m.Pin("pinned")
+	idem := NewIdempotency(m)
+
+	for i := 0; i < 2; i++ {
+		seen, err := idem.Seen("req", 10)
+		s.Require().Equal(ErrFull, err)
+		s.Require().Equal(false, seen)
+	}
+}
+
+func (s *TTLMapSuite) seen(idem *Idempotency, requestID string, ttlSeconds int) bool {
+	seen, err := idem.Seen(requestID, ttlSeconds)
+	s.Require().Equal(nil, err)
+	return seen
+}
+
+func (s *TTLMapSuite) TestIdempotencySeenConcurrent() {
+	idem := NewIdempotency(NewTTLMap(10))
+
+	var firstSeen int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if seen, err := idem.Seen("req", 10); err == nil && !seen {
+				atomic.AddInt64(&firstSeen, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.Require().Equal(int64(1), firstSeen)
+}
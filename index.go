@@ -0,0 +1,116 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"sync/atomic"
+)
+
+// secondaryIndex maps keys derived from values to the keys
+// of entries holding these values
+type secondaryIndex struct {
+	derive func(value interface{}) (string, bool)
+	keys   map[string]map[string]struct{}
+}
+
+// WithSecondaryIndex indexes entries by the key derive returns for their
+// values, so that they can be looked up by it with GetBySecondary. Values
+// for which derive returns false are not indexed.
+func WithSecondaryIndex(name string, derive func(value interface{}) (string, bool)) Option {
+	return func(m *TTLMap) {
+		if m.indexes == nil {
+			m.indexes = make(map[string]*secondaryIndex)
+		}
+		m.indexes[name] = &secondaryIndex{
+			derive: derive,
+			keys:   make(map[string]map[string]struct{}),
+		}
+	}
+}
+
+// GetBySecondary returns the value of a live entry indexed under
+// secondaryKey by the named secondary index. If several entries share
+// the secondary key, the one expiring last is returned.
+func (m *TTLMap) GetBySecondary(name, secondaryKey string) (interface{}, bool) {
+	m.rLock()
+	var found *mapElement
+	if index, ok := m.indexes[name]; ok {
+		now := int(m.getClock().Now().Unix())
+		for key := range index.keys[secondaryKey] {
+			mapEl := m.elements[key]
+			if mapEl.heapEl.Priority <= now {
+				continue
+			}
+			if found == nil || mapEl.heapEl.Priority > found.heapEl.Priority ||
+				(mapEl.heapEl.Priority == found.heapEl.Priority && mapEl.key < found.key) {
+				found = mapEl
+			}
+		}
+	}
+	var value interface{}
+	var err error
+	if found != nil {
+		value, err = m.decodeValue(found)
+	}
+	m.rUnlock()
+
+	m.notifyErrors(err)
+	if found == nil || err != nil {
+		atomic.AddInt64(&m.stats.misses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&m.stats.hits, 1)
+	return m.copyValue(value), true
+}
+
+// index adds the entry to the secondary indexes
+func (m *TTLMap) index(mapEl *mapElement) {
+	if len(m.indexes) == 0 {
+		return
+	}
+	value, ok := m.valueOf(mapEl)
+	if !ok {
+		return
+	}
+	for name, index := range m.indexes {
+		secondaryKey, ok := index.derive(value)
+		if !ok {
+			continue
+		}
+		keys, ok := index.keys[secondaryKey]
+		if !ok {
+			keys = make(map[string]struct{})
+			index.keys[secondaryKey] = keys
+		}
+		keys[mapEl.key] = struct{}{}
+		if mapEl.secondary == nil {
+			mapEl.secondary = make(map[string]string)
+		}
+		mapEl.secondary[name] = secondaryKey
+	}
+}
+
+// unindex removes the entry from the secondary indexes
+func (m *TTLMap) unindex(mapEl *mapElement) {
+	for name, secondaryKey := range mapEl.secondary {
+		keys := m.indexes[name].keys[secondaryKey]
+		delete(keys, mapEl.key)
+		if len(keys) == 0 {
+			delete(m.indexes[name].keys, secondaryKey)
+		}
+	}
+	mapEl.secondary = nil
+}
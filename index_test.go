@@ -0,0 +1,68 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+type session struct {
+	id   string
+	user string
+}
+
+func (s *TTLMapSuite) TestSecondaryIndex() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock, WithSecondaryIndex("user", func(value interface{}) (string, bool) {
+		sess, ok := value.(session)
+		return sess.user, ok
+	}))
+
+	m.Set("s1", session{id: "s1", user: "alice"}, 3)
+	m.Set("s2", session{id: "s2", user: "bob"}, 1)
+	m.Set("s3", session{id: "s3", user: "alice"}, 5)
+	m.Set("other", 1, 10)
+
+	value, exists := m.GetBySecondary("user", "alice")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(session{id: "s3", user: "alice"}, value)
+
+	value, exists = m.GetBySecondary("user", "bob")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(session{id: "s2", user: "bob"}, value)
+
+	clock.Advance(time.Second)
+	_, exists = m.GetBySecondary("user", "bob")
+	s.Require().Equal(false, exists)
+
+	clock.Advance(4 * time.Second)
+	m.RemoveExpired(10)
+	_, exists = m.GetBySecondary("user", "alice")
+	s.Require().Equal(false, exists)
+	s.Require().Empty(m.indexes["user"].keys)
+
+	m.Set("s1", session{id: "s1", user: "alice"}, 10)
+	m.Set("s1", session{id: "s1", user: "carol"}, 10)
+	_, exists = m.GetBySecondary("user", "alice")
+	s.Require().Equal(false, exists)
+	_, exists = m.GetBySecondary("user", "carol")
+	s.Require().Equal(true, exists)
+
+	_, exists = m.GetBySecondary("missing", "carol")
+	s.Require().Equal(false, exists)
+}
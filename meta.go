@@ -0,0 +1,60 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+// SetWithMeta is like Set but also stores meta along with the value,
+// it can be read back with GetWithMetadata. Overwriting the entry with
+// Set drops its meta.
+func (m *TTLMap) SetWithMeta(key string, value interface{}, ttlSeconds int, meta map[string]string) error {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return err
+	}
+	value, err = m.prepareValue(value)
+	if err != nil {
+		return err
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	if err := m.set(key, value, expiryTime); err != nil {
+		return err
+	}
+	m.elements[key].meta = copyMeta(meta)
+	return nil
+}
+
+// GetWithMetadata is like Get but also returns the meta the entry was
+// stored with by SetWithMeta
+func (m *TTLMap) GetWithMetadata(key string) (interface{}, map[string]string, bool) {
+	value, mapEl, _, exists := m.getFresh(key)
+	if !exists {
+		return nil, nil, false
+	}
+	return value, copyMeta(mapEl.meta), true
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(meta))
+	for k, v := range meta {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestSetWithMeta() {
+	m := newTTLMap(10, clockwork.NewFakeClock())
+
+	meta := map[string]string{"source": "db", "etag": "v1"}
+	s.Require().Equal(nil, m.SetWithMeta("a", 1, 10, meta))
+	meta["etag"] = "v2"
+
+	value, got, exists := m.GetWithMetadata("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(1, value)
+	s.Require().Equal(map[string]string{"source": "db", "etag": "v1"}, got)
+
+	s.Require().Equal(nil, m.SetWithMeta("a", 2, 10, map[string]string{"etag": "v3"}))
+	_, got, _ = m.GetWithMetadata("a")
+	s.Require().Equal(map[string]string{"etag": "v3"}, got)
+
+	s.Require().Equal(nil, m.Set("a", 3, 10))
+	value, got, exists = m.GetWithMetadata("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(3, value)
+	s.Require().Nil(got)
+
+	_, _, exists = m.GetWithMetadata("b")
+	s.Require().Equal(false, exists)
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// persistedEntry is an entry as written by WriteTo, ExpiresAt is the
+// expiry time in unix seconds or 0 if the entry never expires. Encoded
+// holds the value instead of Value if it was encoded with a ValueCodec.
+type persistedEntry struct {
+	Key       string
+	Value     interface{}
+	Encoded   []byte
+	ExpiresAt int64
+}
+
+// ValueCodec encodes and decodes values written by WriteTo and
+// read by ReadFrom
+type ValueCodec interface {
+	Encode(value interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// WithPersistCodec makes WriteTo and ReadFrom encode values with codec
+// instead of gob, e.g. for types that are not registered with gob.
+// Entries are still framed with gob. ReadFrom also reads entries written
+// without a codec.
+func WithPersistCodec(codec ValueCodec) Option {
+	return func(m *TTLMap) {
+		m.persistCodec = codec
+	}
+}
+
+// WriteTo writes the live entries with their expiry times to w encoded
+// with encoding/gob, to be read back with ReadFrom. Values of types other
+// than the builtin ones have to be registered with gob.Register, unless
+// they are encoded by WithPersistCodec. Tags, metadata and pins are not
+// written. Nothing is written if a value can not be encoded.
+func (m *TTLMap) WriteTo(w io.Writer) (int64, error) {
+	return m.writeEntries(w, nil)
+}
+
+// SaveFiltered is like WriteTo but writes only the live entries for which
+// pred returns true, e.g. the entries of one tenant. They are read back
+// with ReadFrom. pred is called without the map lock held.
+func (m *TTLMap) SaveFiltered(w io.Writer, pred func(key string, value interface{}) bool) error {
+	_, err := m.writeEntries(w, pred)
+	return err
+}
+
+// writeEntries writes the live entries accepted by pred, or all of them
+// if pred is nil, as described by WriteTo
+func (m *TTLMap) writeEntries(w io.Writer, pred func(key string, value interface{}) bool) (int64, error) {
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	persisted, err := m.persistedEntries()
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range persisted {
+		if pred != nil && !pred(entry.Key, m.copyValue(entry.Value)) {
+			continue
+		}
+		if m.persistCodec != nil {
+			encoded, err := m.persistCodec.Encode(entry.Value)
+			if err != nil {
+				return 0, fmt.Errorf("failed to encode entry %q: %v", entry.Key, err)
+			}
+			entry.Value, entry.Encoded = nil, encoded
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return 0, fmt.Errorf("failed to encode entry %q: %v", entry.Key, err)
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+// ReadFrom stores the entries written by WriteTo with their original
+// expiry times, entries that have expired since are skipped. Capacity
+// eviction applies as with Set. Nothing is stored if r can not be decoded.
+func (m *TTLMap) ReadFrom(r io.Reader) (int64, error) {
+	counter := &countingReader{r: r}
+	decoder := gob.NewDecoder(counter)
+	var entries []persistedEntry
+	for {
+		var entry persistedEntry
+		err := decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return counter.n, fmt.Errorf("failed to decode entry: %v", err)
+		}
+		if entry.Encoded != nil {
+			if m.persistCodec == nil {
+				return counter.n, fmt.Errorf("entry %q was written with a value codec", entry.Key)
+			}
+			entry.Value, err = m.persistCodec.Decode(entry.Encoded)
+			if err != nil {
+				return counter.n, fmt.Errorf("failed to decode entry %q: %v", entry.Key, err)
+			}
+			entry.Encoded = nil
+		}
+		entries = append(entries, entry)
+	}
+
+	return counter.n, m.restore(entries)
+}
+
+// jsonEntry is an entry as marshaled to JSON, ExpiresAt is left out
+// if the entry never expires
+type jsonEntry struct {
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value"`
+	ExpiresAt *time.Time  `json:"expiresAt,omitempty"`
+}
+
+// MarshalJSON encodes the live entries as an array of objects with the
+// key, value and expiresAt, the RFC3339 expiry time. Tags, metadata and
+// pins are not encoded.
+func (m *TTLMap) MarshalJSON() ([]byte, error) {
+	persisted, err := m.persistedEntries()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]jsonEntry, len(persisted))
+	for i, entry := range persisted {
+		entries[i] = jsonEntry{Key: entry.Key, Value: entry.Value}
+		if entry.ExpiresAt != 0 {
+			expiresAt := time.Unix(entry.ExpiresAt, 0).UTC()
+			entries[i].ExpiresAt = &expiresAt
+		}
+	}
+	return json.Marshal(entries)
+}
+
+// UnmarshalJSON stores the entries encoded by MarshalJSON with their
+// original expiry times, entries that have expired since are skipped.
+// The map has to be created with NewTTLMap first. Values are decoded as
+// by json.Unmarshal into an interface{}, i.e. numbers become float64 and
+// objects become map[string]interface{}.
+func (m *TTLMap) UnmarshalJSON(data []byte) error {
+	var decoded []jsonEntry
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	entries := make([]persistedEntry, len(decoded))
+	for i, entry := range decoded {
+		entries[i] = persistedEntry{Key: entry.Key, Value: entry.Value}
+		if entry.ExpiresAt != nil {
+			entries[i].ExpiresAt = entry.ExpiresAt.Unix()
+			if entry.ExpiresAt.Nanosecond() > 0 {
+				entries[i].ExpiresAt += 1
+			}
+		}
+	}
+	return m.restore(entries)
+}
+
+// persistedEntries returns the live entries with their expiry times,
+// it errors if a value fails to decode
+func (m *TTLMap) persistedEntries() ([]persistedEntry, error) {
+	m.rLock()
+	defer m.rUnlock()
+
+	live := m.liveElements(int(m.getClock().Now().Unix()))
+	entries := make([]persistedEntry, len(live))
+	for i, mapEl := range live {
+		value, err := m.decodeValue(mapEl)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = persistedEntry{Key: mapEl.key, Value: value}
+		if mapEl.heapEl.Priority != noExpiry {
+			entries[i].ExpiresAt = int64(mapEl.heapEl.Priority)
+		}
+	}
+	return entries, nil
+}
+
+// restore stores the entries with their expiry times skipping the expired
+// ones, nothing is stored if a value is rejected
+func (m *TTLMap) restore(entries []persistedEntry) error {
+	values := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		value, err := m.prepareValue(entry.Value)
+		if err != nil {
+			return fmt.Errorf("failed to store entry %q: %v", entry.Key, err)
+		}
+		values[i] = value
+	}
+
+	m.lock()
+	defer m.unlock()
+	now := int(m.getClock().Now().Unix())
+	for i, entry := range entries {
+		expiryTime := noExpiry
+		if entry.ExpiresAt != 0 {
+			expiryTime = int(entry.ExpiresAt)
+		}
+		if expiryTime <= now {
+			continue
+		}
+		if err := m.set(entry.Key, values[i], expiryTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
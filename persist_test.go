@@ -0,0 +1,172 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestWriteToReadFrom() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock, WithNoExpiry())
+	m.Set("a", 1, 1)
+	m.Set("b", "two", 5)
+	m.Set("c", []byte("three"), 10)
+	m.Set("d", 4.5, 0)
+
+	var buf bytes.Buffer
+	written, err := m.WriteTo(&buf)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(int64(buf.Len()), written)
+
+	clock.Advance(3 * time.Second)
+	loaded := newTTLMap(10, clock)
+	read, err := loaded.ReadFrom(&buf)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(written, read)
+
+	s.Require().Equal(map[string]interface{}{"b": "two", "c": []byte("three"), "d": 4.5}, loaded.Dump())
+	_, ttl, _ := loaded.GetWithTTL("b")
+	s.Require().Equal(2*time.Second, ttl)
+	_, ttl, _ = loaded.GetWithTTL("c")
+	s.Require().Equal(7*time.Second, ttl)
+	_, ttl, _ = loaded.GetWithTTL("d")
+	s.Require().Equal(time.Duration(0), ttl)
+}
+
+// jsonCodec is a ValueCodec encoding profile values as JSON
+type jsonCodec struct{}
+
+type profile struct {
+	User  string
+	Roles []string
+}
+
+func (jsonCodec) Encode(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Decode(data []byte) (interface{}, error) {
+	var value profile
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+func (s *TTLMapSuite) TestWriteToReadFromCodec() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock, WithPersistCodec(jsonCodec{}))
+	m.Set("alice", profile{User: "alice", Roles: []string{"admin"}}, 5)
+	m.Set("bob", profile{User: "bob"}, 10)
+
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	s.Require().Equal(nil, err)
+	data := buf.Bytes()
+
+	clock.Advance(2 * time.Second)
+	loaded := newTTLMap(10, clock, WithPersistCodec(jsonCodec{}))
+	_, err = loaded.ReadFrom(bytes.NewReader(data))
+	s.Require().Equal(nil, err)
+	s.Require().Equal(map[string]interface{}{
+		"alice": profile{User: "alice", Roles: []string{"admin"}},
+		"bob":   profile{User: "bob"},
+	}, loaded.Dump())
+	_, ttl, _ := loaded.GetWithTTL("alice")
+	s.Require().Equal(3*time.Second, ttl)
+	_, ttl, _ = loaded.GetWithTTL("bob")
+	s.Require().Equal(8*time.Second, ttl)
+
+	_, err = newTTLMap(10, clock).ReadFrom(bytes.NewReader(data))
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), "was written with a value codec")
+}
+
+func (s *TTLMapSuite) TestSaveFiltered() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+	m.Set("acme/a", 1, 5)
+	m.Set("acme/b", 2, 10)
+	m.Set("other/a", 3, 10)
+
+	var buf bytes.Buffer
+	err := m.SaveFiltered(&buf, func(key string, _ interface{}) bool {
+		return strings.HasPrefix(key, "acme/")
+	})
+	s.Require().Equal(nil, err)
+
+	clock.Advance(time.Second)
+	loaded := newTTLMap(10, clock)
+	_, err = loaded.ReadFrom(&buf)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(map[string]interface{}{"acme/a": 1, "acme/b": 2}, loaded.Dump())
+	_, ttl, _ := loaded.GetWithTTL("acme/a")
+	s.Require().Equal(4*time.Second, ttl)
+}
+
+func (s *TTLMapSuite) TestWriteToNotEncodable() {
+	m := newTTLMap(10, clockwork.NewFakeClock())
+	m.Set("a", 1, 10)
+	m.Set("f", func() {}, 10)
+
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), `failed to encode entry "f"`)
+	s.Require().Equal(0, buf.Len())
+}
+
+func (s *TTLMapSuite) TestReadFromCorrupted() {
+	m := newTTLMap(10, clockwork.NewFakeClock())
+	_, err := m.ReadFrom(bytes.NewReader([]byte("not gob")))
+	s.Require().Error(err)
+	s.Require().Equal(0, m.Len())
+}
+
+func (s *TTLMapSuite) TestJSON() {
+	clock := clockwork.NewFakeClockAt(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	m := newTTLMap(10, clock, WithNoExpiry())
+	m.Set("a", 1, 1)
+	m.Set("b", map[string]interface{}{"x": "y"}, 5)
+	m.Set("c", "never", 0)
+
+	data, err := json.Marshal(m)
+	s.Require().Equal(nil, err)
+	var decoded []map[string]interface{}
+	s.Require().Equal(nil, json.Unmarshal(data, &decoded))
+	s.Require().Len(decoded, 3)
+	for _, entry := range decoded {
+		if entry["key"] == "b" {
+			s.Require().Equal("2020-01-01T00:00:05Z", entry["expiresAt"])
+		}
+		if entry["key"] == "c" {
+			s.Require().NotContains(entry, "expiresAt")
+		}
+	}
+
+	clock.Advance(2 * time.Second)
+	loaded := newTTLMap(10, clock)
+	s.Require().Equal(nil, json.Unmarshal(data, loaded))
+	s.Require().Equal(map[string]interface{}{"b": map[string]interface{}{"x": "y"}, "c": "never"}, loaded.Dump())
+	_, ttl, _ := loaded.GetWithTTL("b")
+	s.Require().Equal(3*time.Second, ttl)
+
+	s.Require().Error(json.Unmarshal([]byte(`{"a": 1}`), loaded))
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"errors"
+)
+
+// ErrFull is returned when the map is at capacity and no entry can be
+// evicted to make room for a new one, because all entries are pinned
+var ErrFull = errors.New("map is full")
+
+// Pin protects the entry stored under key from capacity eviction, it is
+// still removed once it expires. The entry stays pinned when overwritten.
+// Pin returns false if there is no such entry.
+func (m *TTLMap) Pin(key string) bool {
+	return m.setPinned(key, true)
+}
+
+// Unpin makes the entry stored under key subject to capacity eviction
+// again, it returns false if there is no such entry
+func (m *TTLMap) Unpin(key string) bool {
+	return m.setPinned(key, false)
+}
+
+func (m *TTLMap) setPinned(key string, pinned bool) bool {
+	m.lock()
+	defer m.unlock()
+
+	mapEl, expired := m.get(key)
+	if mapEl == nil || expired {
+		return false
+	}
+	if mapEl.pinned != pinned {
+		mapEl.pinned = pinned
+		if pinned {
+			m.pinnedCount += 1
+		} else {
+			m.pinnedCount -= 1
+		}
+	}
+	return true
+}
+
+// evictionVictim returns the entry to be removed to free space, which is
+// the entry closest to its expiry that is either not pinned or expired,
+// or the entry chosen by PolicyLFU
+func (m *TTLMap) evictionVictim(now int) *mapElement {
+	if m.policy == PolicyLFU {
+		return m.leastFrequentlyUsed(now)
+	}
+	if m.expiryTimes.Len() == 0 {
+		return nil
+	}
+	if m.pinnedCount == 0 {
+		return m.expiryTimes.Peek().Value.(*mapElement)
+	}
+	// Pinned entries are few, so they are popped off the queue until
+	// an entry that can be evicted shows up and pushed back after
+	var skipped []*PQItem
+	var victim *mapElement
+	for m.expiryTimes.Len() > 0 {
+		heapEl := m.expiryTimes.Peek()
+		mapEl := heapEl.Value.(*mapElement)
+		if !mapEl.pinned || heapEl.Priority <= now {
+			victim = mapEl
+			break
+		}
+		skipped = append(skipped, m.expiryTimes.Pop())
+	}
+	for _, heapEl := range skipped {
+		m.expiryTimes.Push(heapEl)
+	}
+	return victim
+}
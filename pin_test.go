@@ -0,0 +1,98 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestPin() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(3, clock)
+	m.Set("config", "c", 5)
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 20)
+
+	s.Require().Equal(true, m.Pin("config"))
+	s.Require().Equal(false, m.Pin("missing"))
+
+	s.Require().Equal(nil, m.Set("c", 3, 30))
+	s.Require().Equal(nil, m.Set("config", "c2", 5))
+	s.Require().Equal(nil, m.Set("d", 4, 30))
+	s.Require().Equal(map[string]bool{"config": true, "a": false, "b": false, "c": true, "d": true},
+		m.ContainsAll([]string{"config", "a", "b", "c", "d"}))
+
+	will, victim := m.WouldEvict("e")
+	s.Require().Equal(true, will)
+	s.Require().Equal("c", victim)
+
+	clock.Advance(5 * time.Second)
+	s.Require().Equal(nil, m.Set("e", 5, 30))
+	_, exists := m.Get("config")
+	s.Require().Equal(false, exists)
+
+	s.Require().Equal(true, m.Unpin("c"))
+	s.Require().Equal(false, m.Unpin("config"))
+}
+
+func (s *TTLMapSuite) TestPinAllFull() {
+	m := newTTLMap(2, clockwork.NewFakeClock())
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 10)
+	m.Pin("a")
+	m.Pin("b")
+
+	s.Require().Equal(ErrFull, m.Set("c", 3, 10))
+	s.Require().Equal(2, m.Len())
+	will, _ := m.WouldEvict("c")
+	s.Require().Equal(false, will)
+
+	s.Require().Equal(nil, m.Set("a", 10, 10))
+	s.Require().Equal(true, m.Unpin("b"))
+	s.Require().Equal(nil, m.Set("c", 3, 10))
+	s.Require().Equal(map[string]bool{"a": true, "b": false, "c": true},
+		m.ContainsAll([]string{"a", "b", "c"}))
+}
+
+func (s *TTLMapSuite) TestPinFullOverwriteKeepsEntry() {
+	m := newTTLMap(10, clockwork.NewFakeClock(), WithMaxCost(10, func(value interface{}) int {
+		if _, ok := value.(*testCloser); ok {
+			return 3
+		}
+		return len(value.(string))
+	}))
+	s.Require().Equal(nil, m.Set("p", "12345", 10))
+	m.Pin("p")
+	s.Require().Equal(nil, m.SetWithTags("a", "abc", 10, "tag"))
+
+	s.Require().Equal(ErrFull, m.Set("a", "abcdefgh", 10))
+	value, exists := m.Get("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal("abc", value)
+	s.Require().Equal(8, m.totalCost)
+	s.Require().Equal(1, m.InvalidateTag("tag"))
+
+	c := &testCloser{}
+	s.Require().Equal(nil, m.SetCloser("c", c, 10))
+	s.Require().Equal(ErrFull, m.Set("c", "abcdefgh", 10))
+	s.Require().Equal(0, c.closed)
+	value, _ = m.Get("c")
+	s.Require().Equal(c, value)
+	m.Remove("c")
+	s.Require().Equal(1, c.closed)
+}
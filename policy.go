@@ -0,0 +1,87 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"sync/atomic"
+)
+
+// EvictionPolicy selects the entry evicted when the map is at capacity
+type EvictionPolicy int
+
+const (
+	// PolicyLRU evicts the entry closest to its expiry, the same entry
+	// RemoveLastUsed removes. This is the default policy.
+	PolicyLRU EvictionPolicy = iota
+	// PolicyLFU evicts the entry read the least number of times, breaking
+	// ties by the entry read or stored the longest time ago. Finding it
+	// takes a scan over all entries.
+	PolicyLFU
+)
+
+// WithEvictionPolicy sets the policy choosing which entry is evicted when
+// the map is at capacity, expired entries are always evicted first
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(m *TTLMap) {
+		m.policy = policy
+	}
+}
+
+// AccessCount returns the number of times the live entry stored under key
+// was read since it was stored, it returns false if there is no such entry
+func (m *TTLMap) AccessCount(key string) (int64, bool) {
+	m.rLock()
+	defer m.rUnlock()
+
+	mapEl, expired := m.get(key)
+	if mapEl == nil || expired {
+		return 0, false
+	}
+	return atomic.LoadInt64(&mapEl.accesses), true
+}
+
+// countAccess records a read of the entry. Reads only hold the read lock,
+// so the access counters are updated atomically.
+func (m *TTLMap) countAccess(mapEl *mapElement) {
+	atomic.AddInt64(&mapEl.accesses, 1)
+	if m.policy != PolicyLFU {
+		return
+	}
+	atomic.StoreInt64(&mapEl.lastAccess, atomic.AddInt64(&m.accessTick, 1))
+}
+
+// leastFrequentlyUsed returns the entry PolicyLFU evicts, which is the
+// entry furthest past its expiry if any has expired, otherwise the least
+// read entry that is not pinned
+func (m *TTLMap) leastFrequentlyUsed(now int) *mapElement {
+	if m.expiryTimes.Len() > 0 && m.expiryTimes.Peek().Priority <= now {
+		return m.expiryTimes.Peek().Value.(*mapElement)
+	}
+	var victim *mapElement
+	var victimAccesses, victimLastAccess int64
+	for _, mapEl := range m.elements {
+		if mapEl.pinned && mapEl.heapEl.Priority > now {
+			continue
+		}
+		accesses := atomic.LoadInt64(&mapEl.accesses)
+		lastAccess := atomic.LoadInt64(&mapEl.lastAccess)
+		if victim == nil || accesses < victimAccesses ||
+			(accesses == victimAccesses && lastAccess < victimLastAccess) {
+			victim, victimAccesses, victimLastAccess = mapEl, accesses, lastAccess
+		}
+	}
+	return victim
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestEvictionPolicy() {
+	hotKeySurvives := func(policy EvictionPolicy) bool {
+		m := newTTLMap(3, clockwork.NewFakeClock(), WithEvictionPolicy(policy))
+		s.Require().Equal(nil, m.Set("hot", 0, 5))
+		for i := 0; i < 10; i++ {
+			_, exists := m.Get("hot")
+			s.Require().Equal(true, exists)
+		}
+		for i := 0; i < 10; i++ {
+			s.Require().Equal(nil, m.Set(fmt.Sprint("cold", i), i, 10))
+		}
+		_, exists := m.Peek("hot")
+		return exists
+	}
+
+	s.Require().Equal(false, hotKeySurvives(PolicyLRU))
+	s.Require().Equal(true, hotKeySurvives(PolicyLFU))
+}
+
+func (s *TTLMapSuite) TestEvictionPolicyLFUTies() {
+	m := newTTLMap(3, clockwork.NewFakeClock(), WithEvictionPolicy(PolicyLFU))
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 10)
+	m.Set("c", 3, 10)
+	m.Get("a")
+	m.Get("b")
+	m.GetInt("c")
+	m.Get("a")
+
+	// b and c were read once, b longer ago
+	will, victim := m.WouldEvict("d")
+	s.Require().Equal(true, will)
+	s.Require().Equal("b", victim)
+
+	m.Pin("b")
+	s.Require().Equal(nil, m.Set("d", 4, 10))
+	s.Require().Equal(map[string]bool{"a": true, "b": true, "c": false, "d": true},
+		m.ContainsAll([]string{"a", "b", "c", "d"}))
+}
+
+func (s *TTLMapSuite) TestEvictionPolicyLFUExpiredFirst() {
+	for _, opts := range [][]Option{nil, {WithAsyncSweeps()}} {
+		clock := clockwork.NewFakeClock()
+		m := newTTLMap(2, clock, append(opts, WithEvictionPolicy(PolicyLFU))...)
+		m.Set("live", 1, 10)
+		m.Set("old", 2, 1)
+		m.Get("old")
+		clock.Advance(time.Second)
+
+		will, victim := m.WouldEvict("new")
+		s.Require().Equal(true, will)
+		s.Require().Equal("old", victim)
+
+		s.Require().Equal(nil, m.Set("new", 3, 10))
+		_, exists := m.Peek("live")
+		s.Require().Equal(true, exists)
+	}
+}
+
+func (s *TTLMapSuite) TestAccessCount() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(3, clock)
+	m.Set("a", 1, 5)
+
+	count, exists := m.AccessCount("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(int64(0), count)
+
+	for i := 0; i < 3; i++ {
+		m.Get("a")
+	}
+	m.GetInt("a")
+	m.Peek("a")
+	m.Get("missing")
+	count, _ = m.AccessCount("a")
+	s.Require().Equal(int64(4), count)
+
+	m.Set("a", 2, 5)
+	count, _ = m.AccessCount("a")
+	s.Require().Equal(int64(0), count)
+
+	_, exists = m.AccessCount("missing")
+	s.Require().Equal(false, exists)
+	clock.Advance(5 * time.Second)
+	count, exists = m.AccessCount("a")
+	s.Require().Equal(false, exists)
+	s.Require().Equal(int64(0), count)
+}
@@ -33,7 +33,13 @@ type PriorityQueue struct {
 }
 
 func NewPriorityQueue() *PriorityQueue {
-	mh := &pqImpl{}
+	return newPriorityQueue(nil)
+}
+
+// newPriorityQueue returns a queue ordering items with equal
+// priority by tieBreaker, if set
+func newPriorityQueue(tieBreaker func(a, b *PQItem) bool) *PriorityQueue {
+	mh := &pqImpl{tieBreaker: tieBreaker}
 	heap.Init(mh)
 	return &PriorityQueue{impl: mh}
 }
@@ -50,7 +56,7 @@ func (p *PriorityQueue) Pop() *PQItem {
 }
 
 func (p *PriorityQueue) Peek() *PQItem {
-	return (*p.impl)[0]
+	return p.impl.items[0]
 }
 
 // Modifies the priority and value of an Item in the queue.
@@ -64,33 +70,57 @@ func (p *PriorityQueue) Remove(el *PQItem) {
 	heap.Remove(p.impl, el.index)
 }
 
+// countUpTo returns the number of items with priority up to priority,
+// visiting only those items and their direct children
+func (p *PriorityQueue) countUpTo(priority int) int {
+	count := 0
+	stack := []int{0}
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if i >= len(p.impl.items) || p.impl.items[i].Priority > priority {
+			continue
+		}
+		count += 1
+		stack = append(stack, 2*i+1, 2*i+2)
+	}
+	return count
+}
+
 // Actual Implementation using heap.Interface
-type pqImpl []*PQItem
+type pqImpl struct {
+	items      []*PQItem
+	tieBreaker func(a, b *PQItem) bool
+}
 
-func (mh pqImpl) Len() int { return len(mh) }
+func (mh pqImpl) Len() int { return len(mh.items) }
 
 func (mh pqImpl) Less(i, j int) bool {
-	return mh[i].Priority < mh[j].Priority
+	a, b := mh.items[i], mh.items[j]
+	if a.Priority == b.Priority && mh.tieBreaker != nil {
+		return mh.tieBreaker(a, b)
+	}
+	return a.Priority < b.Priority
 }
 
 func (mh pqImpl) Swap(i, j int) {
-	mh[i], mh[j] = mh[j], mh[i]
-	mh[i].index = i
-	mh[j].index = j
+	mh.items[i], mh.items[j] = mh.items[j], mh.items[i]
+	mh.items[i].index = i
+	mh.items[j].index = j
 }
 
 func (mh *pqImpl) Push(x interface{}) {
-	n := len(*mh)
+	n := len(mh.items)
 	item := x.(*PQItem)
 	item.index = n
-	*mh = append(*mh, item)
+	mh.items = append(mh.items, item)
 }
 
 func (mh *pqImpl) Pop() interface{} {
-	old := *mh
+	old := mh.items
 	n := len(old)
 	item := old[n-1]
 	item.index = -1 // for safety
-	*mh = old[0 : n-1]
+	mh.items = old[0 : n-1]
 	return item
 }
@@ -88,7 +88,7 @@ func TestUpdate(t *testing.T) {
 	assert.Equal(t, 1, toInt(mh.Peek().Value))
 }
 
-func Example_Priority_Queue_Usage() {
+func ExamplePriorityQueue() {
 	queue := NewPriorityQueue()
 
 	queue.Push(&PQItem{
@@ -0,0 +1,79 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"time"
+)
+
+// ringSeconds is the longest window in seconds event rings keep track of
+const ringSeconds = 300
+
+// eventRing counts events in one second buckets over the last ringSeconds.
+// Only seconds with events have a bucket, so that an idle ring takes no
+// memory.
+type eventRing struct {
+	// in ascending order of seconds
+	buckets []eventBucket
+}
+
+type eventBucket struct {
+	second int64
+	count  int64
+}
+
+func (r *eventRing) add(now time.Time) {
+	second := now.Unix()
+	// The clock may have been moved back
+	i := len(r.buckets)
+	for i > 0 && r.buckets[i-1].second > second {
+		i -= 1
+	}
+	if i > 0 && r.buckets[i-1].second == second {
+		r.buckets[i-1].count += 1
+		return
+	}
+	r.buckets = append(r.buckets, eventBucket{})
+	copy(r.buckets[i+1:], r.buckets[i:])
+	r.buckets[i] = eventBucket{second: second, count: 1}
+
+	// drop the buckets too old to be counted
+	cutoff := r.buckets[len(r.buckets)-1].second - ringSeconds
+	old := 0
+	for old < len(r.buckets) && r.buckets[old].second <= cutoff {
+		old += 1
+	}
+	if old > 0 {
+		r.buckets = append(r.buckets[:0], r.buckets[old:]...)
+	}
+}
+
+// count returns the number of events within window before now,
+// window is capped to ringSeconds
+func (r *eventRing) count(now time.Time, window time.Duration) int64 {
+	seconds := int64((window + time.Second - 1) / time.Second)
+	if seconds > ringSeconds {
+		seconds = ringSeconds
+	}
+	second := now.Unix()
+	var total int64
+	for _, bucket := range r.buckets {
+		if bucket.second > second-seconds && bucket.second <= second {
+			total += bucket.count
+		}
+	}
+	return total
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+)
+
+// ShardedTTLMap spreads entries over independent TTLMaps by key hash, so
+// that operations on different shards don't contend for the same lock.
+// Every shard evicts entries on its own once it holds its share of the
+// capacity, so the capacity is only approximate: entries can be evicted
+// while other shards have room left.
+type ShardedTTLMap struct {
+	// guards shards, which Reshard replaces
+	mutex    sync.RWMutex
+	shards   []*TTLMap
+	capacity int
+	opts     []Option
+}
+
+// NewShardedTTLMap returns a map of shards TTLMaps created with opts.
+// The capacity, as well as the limits set by WithMaxEntries,
+// WithEvictionHysteresis, WithMaxCost and WithMaxWeight, is for the whole
+// map and every shard gets its share of it, rounded up. Every shard gets
+// its own source of randomness seeded from the one set by WithRandSource,
+// if any. Callbacks set by opts are shared and may be called by different
+// shards concurrently.
+func NewShardedTTLMap(capacity, shards int, opts ...Option) *ShardedTTLMap {
+	if shards <= 0 {
+		shards = 1
+	}
+	m := &ShardedTTLMap{capacity: capacity, opts: opts}
+	m.shards = m.newShards(shards)
+	return m
+}
+
+func (m *ShardedTTLMap) newShards(n int) []*TTLMap {
+	shards := make([]*TTLMap, n)
+	for i := range shards {
+		shard := NewTTLMap(m.capacity, m.opts...)
+		shard.capacity = shareOf(shard.capacity, n)
+		shard.lowWatermark = shareOf(shard.lowWatermark, n)
+		shard.maxCost = shareOf(shard.maxCost, n)
+		// rand.Source is not safe for concurrent use, so a source
+		// set by WithRandSource can not be shared by the shards
+		if shard.rand != nil {
+			shard.rand = rand.New(rand.NewSource(shard.rand.Int63()))
+		}
+		shards[i] = shard
+	}
+	return shards
+}
+
+// shareOf returns the share of limit of every of n shards, rounded up
+func shareOf(limit, n int) int {
+	return (limit + n - 1) / n
+}
+
+func (m *ShardedTTLMap) Set(key string, value interface{}, ttlSeconds int) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.shard(key).Set(key, value, ttlSeconds)
+}
+
+func (m *ShardedTTLMap) Get(key string) (interface{}, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.shard(key).Get(key)
+}
+
+func (m *ShardedTTLMap) GetInt(key string) (int, bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.shard(key).GetInt(key)
+}
+
+func (m *ShardedTTLMap) Increment(key string, value int, ttlSeconds int) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.shard(key).Increment(key, value, ttlSeconds)
+}
+
+// Remove removes the entry stored under key and returns its value
+// if it was live, see TTLMap.Remove
+func (m *ShardedTTLMap) Remove(key string) (interface{}, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.shard(key).Remove(key)
+}
+
+// Len returns the number of live entries summed over the shards, which are
+// not locked at the same time
+func (m *ShardedTTLMap) Len() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	count := 0
+	for _, shard := range m.shards {
+		count += shard.Len()
+	}
+	return count
+}
+
+// Reshard redistributes the live entries over newShardCount shards along
+// with their expiry times, tags, metadata, pins and closers, recomputing
+// the shares of the capacity and limits. It is an O(n) operation during
+// which all other operations on the map wait, so callbacks executed
+// meanwhile, e.g. for entries evicted from shards getting more than their
+// share, must not access the map. If an entry is rejected by its new
+// shard, e.g. because it exceeds the new share of WithMaxCost, the map is
+// left unchanged and the error is returned.
+func (m *ShardedTTLMap) Reshard(newShardCount int) error {
+	if newShardCount <= 0 {
+		return fmt.Errorf("newShardCount should be > 0, got %d", newShardCount)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	shards := m.newShards(newShardCount)
+	for _, shard := range m.shards {
+		if err := copyEntries(shard, shards); err != nil {
+			return err
+		}
+	}
+	// closers are handed over only once the copies are all stored,
+	// the old shards keep them otherwise
+	for _, shard := range m.shards {
+		handOverClosers(shard, shards)
+	}
+	m.shards = shards
+	return nil
+}
+
+// copyEntries copies the live entries of from to the shards they hash to,
+// which are not reachable by other callers yet
+func copyEntries(from *TTLMap, shards []*TTLMap) error {
+	from.rLock()
+	defer from.rUnlock()
+
+	for _, mapEl := range from.liveElements(int(from.getClock().Now().Unix())) {
+		shard := shards[shardIndex(mapEl.key, len(shards))]
+		shard.lock()
+		err := shard.copyEntry(mapEl)
+		shard.unlock()
+		if err != nil {
+			return fmt.Errorf("failed to move entry %q: %v", mapEl.key, err)
+		}
+	}
+	return nil
+}
+
+// handOverClosers passes the closers of the entries of from to their
+// copies in shards, closers of entries that were not copied, e.g. because
+// they expired or were evicted while copying, are released
+func handOverClosers(from *TTLMap, shards []*TTLMap) {
+	from.rLock()
+	defer from.rUnlock()
+
+	for _, mapEl := range from.elements {
+		if mapEl.closer == nil {
+			continue
+		}
+		shard := shards[shardIndex(mapEl.key, len(shards))]
+		shard.lock()
+		if copied, ok := shard.elements[mapEl.key]; ok {
+			copied.closer = mapEl.closer
+		} else {
+			shard.releaseCloser(mapEl.closer)
+		}
+		shard.unlock()
+	}
+}
+
+func (m *ShardedTTLMap) shard(key string) *TTLMap {
+	return m.shards[shardIndex(key, len(m.shards))]
+}
+
+// shardIndex returns the index of the shard key hashes to out of n
+func shardIndex(key string, n int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(n))
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestShardedTTLMap() {
+	clock := clockwork.NewFakeClock()
+	m := NewShardedTTLMap(100, 4, WithClock(clock))
+	s.Require().Len(m.shards, 4)
+	s.Require().Equal(25, m.shards[0].capacity)
+
+	for i := 0; i < 50; i++ {
+		s.Require().Equal(nil, m.Set(fmt.Sprint("key", i), i, 10))
+	}
+	s.Require().Equal(50, m.Len())
+	value, exists := m.Get("key7")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(7, value)
+
+	count, err := m.Increment("counter", 2, 5)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(2, count)
+	count, exists, err = m.GetInt("counter")
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, exists)
+	s.Require().Equal(2, count)
+
+	value, exists = m.Remove("key7")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(7, value)
+	_, exists = m.Get("key7")
+	s.Require().Equal(false, exists)
+	s.Require().Equal(50, m.Len())
+
+	clock.Advance(5 * time.Second)
+	s.Require().Equal(49, m.Len())
+
+	s.Require().Len(NewShardedTTLMap(10, 0).shards, 1)
+	s.Require().Equal(4, NewShardedTTLMap(10, 3).shards[0].capacity)
+}
+
+func (s *TTLMapSuite) TestShardedTTLMapOptions() {
+	m := NewShardedTTLMap(100, 4, WithEvictionHysteresis(80, 200), WithMaxCost(40, nil))
+	for _, shard := range m.shards {
+		s.Require().Equal(50, shard.capacity)
+		s.Require().Equal(20, shard.lowWatermark)
+		s.Require().Equal(10, shard.maxCost)
+	}
+
+	// the shards don't share the source, which is not safe for concurrent use
+	m = NewShardedTTLMap(100, 4, WithTTLJitter(0.5), WithRandSource(rand.NewSource(1)))
+	s.Require().NotEqual(m.shards[0].rand, m.shards[1].rand)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Set(fmt.Sprint(i, j), j, 100)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (s *TTLMapSuite) TestReshard() {
+	clock := clockwork.NewFakeClock()
+	m := NewShardedTTLMap(1000, 4, WithClock(clock))
+	for i := 0; i < 100; i++ {
+		s.Require().Equal(nil, m.Set(fmt.Sprint("key", i), i, 10+i))
+	}
+	closer := &testCloser{}
+	s.Require().Equal(nil, m.shard("closed").SetCloser("closed", closer, 10))
+
+	s.Require().EqualError(m.Reshard(0), "newShardCount should be > 0, got 0")
+	s.Require().Equal(nil, m.Reshard(7))
+	s.Require().Len(m.shards, 7)
+	s.Require().Equal(143, m.shards[0].capacity)
+	s.Require().Equal(101, m.Len())
+	for i := 0; i < 100; i++ {
+		value, exists := m.Get(fmt.Sprint("key", i))
+		s.Require().Equal(true, exists)
+		s.Require().Equal(i, value)
+	}
+	_, ttl, _ := m.shard("key50").GetWithTTL("key50")
+	s.Require().Equal(60*time.Second, ttl)
+
+	m.Remove("closed")
+	s.Require().Equal(1, closer.closed)
+
+	clock.Advance(10 * time.Second)
+	s.Require().Equal(99, m.Len())
+}
+
+func (s *TTLMapSuite) TestReshardRejected() {
+	m := NewShardedTTLMap(100, 1, WithMaxCost(100, func(value interface{}) int {
+		return value.(int)
+	}))
+	s.Require().Equal(nil, m.Set("a", 60, 10))
+
+	err := m.Reshard(4)
+	s.Require().EqualError(err, `failed to move entry "a": value too large`)
+	s.Require().Len(m.shards, 1)
+	value, exists := m.Get("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(60, value)
+}
+
+// BenchmarkSharded compares many goroutines reading and writing a single
+// map to them spreading over a sharded map
+func BenchmarkSharded(b *testing.B) {
+	const capacity = 10000
+	keys := make([]string, capacity)
+	for i := range keys {
+		keys[i] = fmt.Sprint(i)
+	}
+	single := NewTTLMap(capacity)
+	sharded := NewShardedTTLMap(capacity, 16)
+	for _, bench := range []struct {
+		name string
+		set  func(key string, value interface{}, ttlSeconds int) error
+		get  func(key string) (interface{}, bool)
+	}{
+		{name: "single lock", set: single.Set, get: single.Get},
+		{name: "16 shards", set: sharded.Set, get: sharded.Get},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetParallelism(64)
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%capacity]
+					if i%4 == 0 {
+						bench.set(key, i, 60)
+					} else {
+						bench.get(key)
+					}
+					i += 1
+				}
+			})
+		})
+	}
+}
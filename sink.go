@@ -0,0 +1,84 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+// expireSink accumulates expired entries and hands them to the
+// sink in batches
+type expireSink struct {
+	sink      func(batch []Entry) error
+	batchSize int
+	pending   []Entry
+}
+
+// WithExpireSink passes expired entries to sink in batches of batchSize
+// instead of one at a time. The last incomplete batch is only passed
+// on Flush. Batches sink fails to accept are not retried, the error is
+// reported to the function set by WithOnError and the batch is dropped.
+// The sink is called once the map lock is released, so it may access the
+// map, but it may be called from concurrent operations at the same time.
+func WithExpireSink(sink func(batch []Entry) error, batchSize int) Option {
+	return func(m *TTLMap) {
+		if batchSize <= 0 {
+			batchSize = 1
+		}
+		m.expireSink = &expireSink{
+			sink:      sink,
+			batchSize: batchSize,
+		}
+	}
+}
+
+// WithOnError sets the function called with errors the map can not
+// return to the caller, e.g. errors returned by the expire sink or
+// values failing to decode
+func WithOnError(onError func(err error)) Option {
+	return func(m *TTLMap) {
+		m.onError = onError
+	}
+}
+
+// Flush passes expired entries accumulated for the expire sink
+// to it, even if they do not fill a whole batch, and returns once
+// the sink has returned
+func (m *TTLMap) Flush() {
+	m.lock()
+	defer m.unlock()
+	m.flushExpired()
+}
+
+// sinkExpired adds the expired entry to the pending batch
+// and passes the batch to the sink once it is full
+func (m *TTLMap) sinkExpired(entry Entry) {
+	s := m.expireSink
+	s.pending = append(s.pending, entry)
+	if len(s.pending) >= s.batchSize {
+		m.flushExpired()
+	}
+}
+
+func (m *TTLMap) flushExpired() {
+	s := m.expireSink
+	if s == nil || len(s.pending) == 0 {
+		return
+	}
+	batch, sink, onError := s.pending, s.sink, m.onError
+	s.pending = nil
+	m.deferUnlock(func() {
+		if err := sink(batch); err != nil && onError != nil {
+			onError(err)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestExpireSink() {
+	clock := clockwork.NewFakeClock()
+	var batches [][]Entry
+	m := newTTLMap(20, clock, WithExpireSink(func(batch []Entry) error {
+		batches = append(batches, batch)
+		return nil
+	}, 4))
+
+	for i := 0; i < 10; i++ {
+		m.Set(fmt.Sprintf("%02d", i), i, 1)
+	}
+	clock.Advance(time.Second)
+	m.RemoveExpired(20)
+
+	s.Require().Equal(2, len(batches))
+	for _, batch := range batches {
+		s.Require().Equal(4, len(batch))
+	}
+	s.Require().Equal(Entry{Key: "00", Value: 0, TTLSeconds: 1}, batches[0][0])
+
+	m.Flush()
+	s.Require().Equal(3, len(batches))
+	s.Require().Equal(2, len(batches[2]))
+
+	m.Flush()
+	s.Require().Equal(3, len(batches))
+}
+
+func (s *TTLMapSuite) TestExpireSinkError() {
+	clock := clockwork.NewFakeClock()
+	var errs []error
+	m := newTTLMap(20, clock, WithExpireSink(func(batch []Entry) error {
+		return errors.New("sink is down")
+	}, 2), WithOnError(func(err error) {
+		errs = append(errs, err)
+	}))
+
+	m.Set("a", 1, 1)
+	m.Set("b", 2, 1)
+	m.Set("c", 3, 1)
+	clock.Advance(time.Second)
+	m.RemoveExpired(20)
+	s.Require().Equal(1, len(errs))
+
+	m.Flush()
+	s.Require().Equal(2, len(errs))
+}
+
+func (s *TTLMapSuite) TestExpireSinkAccessesMap() {
+	clock := clockwork.NewFakeClock()
+	var m *TTLMap
+	var lens []int
+	m = newTTLMap(20, clock, WithExpireSink(func(batch []Entry) error {
+		lens = append(lens, m.Len())
+		return errors.New("sink is down")
+	}, 1), WithOnError(func(err error) {
+		lens = append(lens, m.Len())
+	}))
+
+	m.Set("a", 1, 1)
+	m.Set("b", 2, 10)
+	clock.Advance(time.Second)
+	s.Require().Equal(1, m.RemoveExpired(20))
+	s.Require().Equal([]int{1, 1}, lens)
+}
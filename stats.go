@@ -0,0 +1,176 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds counters accumulated since the map was created
+type Stats struct {
+	// Hits is the number of lookups that found a value
+	Hits int64
+	// Misses is the number of lookups that found no value
+	Misses int64
+	// Expirations is the number of entries removed after their TTL lapsed
+	Expirations int64
+	// CapacityEvictions is the number of entries evicted to free space
+	CapacityEvictions int64
+	// TTLExtensions is the number of times an entry's TTL was prolonged
+	TTLExtensions int64
+	// AvgLockWait and MaxLockWait are the average and longest time spent
+	// waiting for the map lock, only measured WithContentionMetrics
+	AvgLockWait time.Duration
+	MaxLockWait time.Duration
+}
+
+// counters are updated atomically as lookups only hold the read lock
+type counters struct {
+	hits              int64
+	misses            int64
+	expirations       int64
+	capacityEvictions int64
+	ttlExtensions     int64
+	// number, total and longest lock waits in nanoseconds
+	lockWaits     int64
+	lockWaitTotal int64
+	lockWaitMax   int64
+}
+
+func (c *counters) countRemoval(reason Reason) {
+	switch reason {
+	case ReasonExpired:
+		atomic.AddInt64(&c.expirations, 1)
+	case ReasonCapacity:
+		atomic.AddInt64(&c.capacityEvictions, 1)
+	}
+}
+
+func (c *counters) reset() {
+	atomic.StoreInt64(&c.hits, 0)
+	atomic.StoreInt64(&c.misses, 0)
+	atomic.StoreInt64(&c.expirations, 0)
+	atomic.StoreInt64(&c.capacityEvictions, 0)
+	atomic.StoreInt64(&c.ttlExtensions, 0)
+	atomic.StoreInt64(&c.lockWaits, 0)
+	atomic.StoreInt64(&c.lockWaitTotal, 0)
+	atomic.StoreInt64(&c.lockWaitMax, 0)
+}
+
+// Stats returns a snapshot of the map counters
+func (m *TTLMap) Stats() Stats {
+	stats := Stats{
+		Hits:              atomic.LoadInt64(&m.stats.hits),
+		Misses:            atomic.LoadInt64(&m.stats.misses),
+		Expirations:       atomic.LoadInt64(&m.stats.expirations),
+		CapacityEvictions: atomic.LoadInt64(&m.stats.capacityEvictions),
+		TTLExtensions:     atomic.LoadInt64(&m.stats.ttlExtensions),
+		MaxLockWait:       time.Duration(atomic.LoadInt64(&m.stats.lockWaitMax)),
+	}
+	if waits := atomic.LoadInt64(&m.stats.lockWaits); waits > 0 {
+		stats.AvgLockWait = time.Duration(atomic.LoadInt64(&m.stats.lockWaitTotal) / waits)
+	}
+	return stats
+}
+
+// RecentRemovals returns the number of entries removed for the given
+// reason within window, which is capped to five minutes
+func (m *TTLMap) RecentRemovals(reason Reason, window time.Duration) int {
+	m.rLock()
+	defer m.rUnlock()
+
+	if reason < ReasonExpired || reason > ReasonDeleted {
+		return 0
+	}
+	return int(m.removals[reason].count(m.getClock().Now(), window))
+}
+
+// ChurnRatio returns the number of entries evicted due to capacity
+// relative to the number of entries stored within window, which is capped
+// to five minutes. A ratio close to 1 means that almost every insert
+// evicts another entry, i.e. the map is too small for its working set.
+func (m *TTLMap) ChurnRatio(window time.Duration) float64 {
+	m.rLock()
+	defer m.rUnlock()
+
+	now := m.getClock().Now()
+	inserts := m.inserts.count(now, window)
+	if inserts == 0 {
+		return 0
+	}
+	return float64(m.removals[ReasonCapacity].count(now, window)) / float64(inserts)
+}
+
+// TTLOverflow is the RemainingTTLHistogram key counting entries
+// expiring after the last bucket boundary
+const TTLOverflow = time.Duration(math.MaxInt64)
+
+// RemainingTTLHistogram counts live entries by remaining TTL. An entry is
+// counted under the first of the ascending buckets boundaries its TTL does
+// not exceed, or under TTLOverflow if it exceeds all of them. Entries
+// that never expire are counted under TTLOverflow.
+func (m *TTLMap) RemainingTTLHistogram(buckets []time.Duration) map[time.Duration]int {
+	m.rLock()
+	defer m.rUnlock()
+
+	histogram := make(map[time.Duration]int, len(buckets)+1)
+	for _, bucket := range buckets {
+		histogram[bucket] = 0
+	}
+	histogram[TTLOverflow] = 0
+
+	now := m.getClock().Now()
+	for _, mapEl := range m.elements {
+		ttl := mapEl.remaining(now)
+		if ttl <= 0 {
+			continue
+		}
+		bucket := TTLOverflow
+		for _, boundary := range buckets {
+			if ttl <= boundary {
+				bucket = boundary
+				break
+			}
+		}
+		histogram[bucket] += 1
+	}
+	return histogram
+}
+
+// DiffStats returns the difference between two snapshots taken with Stats,
+// e.g. to compute rates over an interval. Counters that went down in
+// between, for example because the map was recreated, are reported as 0.
+// Lock waits are not counters and are taken from after as is.
+func DiffStats(before, after Stats) Stats {
+	return Stats{
+		Hits:              diffCounter(before.Hits, after.Hits),
+		Misses:            diffCounter(before.Misses, after.Misses),
+		Expirations:       diffCounter(before.Expirations, after.Expirations),
+		CapacityEvictions: diffCounter(before.CapacityEvictions, after.CapacityEvictions),
+		TTLExtensions:     diffCounter(before.TTLExtensions, after.TTLExtensions),
+		AvgLockWait:       after.AvgLockWait,
+		MaxLockWait:       after.MaxLockWait,
+	}
+}
+
+func diffCounter(before, after int64) int64 {
+	if after < before {
+		return 0
+	}
+	return after - before
+}
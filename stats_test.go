@@ -0,0 +1,178 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestDiffStats() {
+	before := Stats{Hits: 10, Misses: 5, Expirations: 3, CapacityEvictions: 8, TTLExtensions: 1}
+	after := Stats{Hits: 15, Misses: 5, Expirations: 1, CapacityEvictions: 10, TTLExtensions: 4}
+
+	s.Require().Equal(Stats{Hits: 5, Misses: 0, Expirations: 0, CapacityEvictions: 2, TTLExtensions: 3},
+		DiffStats(before, after))
+}
+
+func (s *TTLMapSuite) TestStats() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock)
+	m.Set("a", 1, 1)
+	m.Set("b", 2, 10)
+
+	m.Get("a")
+	m.Get("b")
+	m.GetInt("b")
+	m.Get("missing")
+	m.GetInt("missing")
+
+	clock.Advance(time.Second)
+	m.Get("a")
+
+	m.Set("c", 3, 20)
+	m.Set("d", 4, 20)
+
+	s.Require().Equal(Stats{Hits: 3, Misses: 3, Expirations: 1, CapacityEvictions: 1}, m.Stats())
+}
+
+func (s *TTLMapSuite) TestRecentRemovals() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1, clock)
+
+	m.Set("a", 1, 100)
+	m.Set("b", 2, 100)
+	clock.Advance(10 * time.Second)
+	m.Set("c", 3, 100)
+	m.Set("d", 4, 100)
+	clock.Advance(1 * time.Second)
+
+	s.Require().Equal(2, m.RecentRemovals(ReasonCapacity, 5*time.Second))
+	s.Require().Equal(3, m.RecentRemovals(ReasonCapacity, 20*time.Second))
+	s.Require().Equal(0, m.RecentRemovals(ReasonExpired, 20*time.Second))
+
+	clock.Advance(time.Hour)
+	s.Require().Equal(0, m.RecentRemovals(ReasonCapacity, time.Hour))
+}
+
+func (s *TTLMapSuite) TestTTLExtensions() {
+	clock := clockwork.NewFakeClock()
+	extended := make(map[string]int64)
+	var m *TTLMap
+	m = newTTLMap(1, clock, WithOnTTLExtended(func(key string, newExpiry time.Time) {
+		// the callback can access the map
+		s.Require().Equal(1, m.Len())
+		extended[key] = newExpiry.Unix()
+	}))
+
+	m.Set("a", 1, 10)
+	clock.Advance(5 * time.Second)
+
+	_, _, err := m.GetAndTouch("a", 10)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(int64(1), m.Stats().TTLExtensions)
+	s.Require().Equal(map[string]int64{"a": clock.Now().Add(10 * time.Second).Unix()}, extended)
+
+	// shortening the TTL is not an extension
+	_, _, err = m.GetAndTouch("a", 1)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(int64(1), m.Stats().TTLExtensions)
+
+	touched, err := m.Touch("a", 20)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, touched)
+	s.Require().Equal(int64(2), m.Stats().TTLExtensions)
+}
+
+func (s *TTLMapSuite) TestRemainingTTLHistogram() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+	m.Set("a", 1, 1)
+	m.Set("b", 2, 30)
+	m.Set("c", 3, 60)
+	m.Set("d", 4, 600)
+	m.Set("e", 5, 7200)
+	m.Set("f", 6, 100000)
+	clock.Advance(time.Second)
+
+	s.Require().Equal(map[time.Duration]int{
+		time.Minute:    2,
+		time.Hour:      1,
+		24 * time.Hour: 1,
+		TTLOverflow:    1,
+	}, m.RemainingTTLHistogram([]time.Duration{time.Minute, time.Hour, 24 * time.Hour}))
+
+	m = newTTLMap(1, clock, WithNoExpiry())
+	m.Set("a", 1, 0)
+	s.Require().Equal(map[time.Duration]int{
+		time.Minute: 0,
+		TTLOverflow: 1,
+	}, m.RemainingTTLHistogram([]time.Duration{time.Minute}))
+}
+
+func (s *TTLMapSuite) TestChurnRatio() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+	s.Require().Equal(0.0, m.ChurnRatio(time.Minute))
+
+	for i := 0; i < 5; i++ {
+		m.Set(fmt.Sprintf("a%d", i), i, 1000)
+	}
+	s.Require().Equal(0.0, m.ChurnRatio(time.Minute))
+
+	clock.Advance(2 * time.Minute)
+	for i := 0; i < 1000; i++ {
+		m.Set(fmt.Sprintf("b%d", i), i, 1000)
+		clock.Advance(10 * time.Millisecond)
+	}
+	s.Require().InDelta(1.0, m.ChurnRatio(time.Minute), 0.01)
+}
+
+func ExampleDiffStats() {
+	m := NewTTLMap(1)
+
+	before := m.Stats()
+	m.Set("a", 1, 10)
+	m.Get("a")
+	m.Get("b")
+	m.Set("b", 2, 10)
+	after := m.Stats()
+
+	delta := DiffStats(before, after)
+	fmt.Printf("Hits: %d, Misses: %d, Evictions: %d", delta.Hits, delta.Misses, delta.CapacityEvictions)
+
+	// Output: Hits: 1, Misses: 1, Evictions: 1
+}
+
+func (s *TTLMapSuite) TestEventRing() {
+	var r eventRing
+	start := time.Unix(1000, 0)
+	for i := 0; i < 2*ringSeconds; i++ {
+		r.add(start.Add(time.Duration(i) * time.Second))
+	}
+	now := start.Add((2*ringSeconds - 1) * time.Second)
+	s.Require().Equal(ringSeconds, len(r.buckets))
+	s.Require().Equal(int64(ringSeconds), r.count(now, time.Hour))
+	s.Require().Equal(int64(10), r.count(now, 10*time.Second))
+
+	// events recorded after the clock was moved back
+	r.add(now.Add(-5 * time.Second))
+	r.add(now.Add(-5 * time.Second))
+	s.Require().Equal(int64(12), r.count(now, 10*time.Second))
+	s.Require().Equal(ringSeconds, len(r.buckets))
+}
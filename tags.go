@@ -0,0 +1,83 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+// SetWithTags is like Set but also tags the entry, so that it can be
+// removed along with other entries carrying the same tag by InvalidateTag.
+// Overwriting the entry with Set drops its tags.
+func (m *TTLMap) SetWithTags(key string, value interface{}, ttlSeconds int, tags ...string) error {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return err
+	}
+	value, err = m.prepareValue(value)
+	if err != nil {
+		return err
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	if err := m.set(key, value, expiryTime); err != nil {
+		return err
+	}
+	m.tag(m.elements[key], tags)
+	return nil
+}
+
+// tag adds the tags to the entry
+func (m *TTLMap) tag(mapEl *mapElement, tags []string) {
+	for _, tag := range tags {
+		keys, ok := m.tags[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			m.tags[tag] = keys
+		}
+		if _, ok := keys[mapEl.key]; !ok {
+			keys[mapEl.key] = struct{}{}
+			mapEl.tags = append(mapEl.tags, tag)
+		}
+	}
+}
+
+// InvalidateTag removes all entries carrying the tag and returns
+// the number of live entries removed
+func (m *TTLMap) InvalidateTag(tag string) int {
+	m.lock()
+	defer m.unlock()
+
+	removed := 0
+	for key := range m.tags[tag] {
+		mapEl, expired := m.get(key)
+		if expired {
+			m.removeElement(mapEl, ReasonExpired)
+			continue
+		}
+		m.removeElement(mapEl, ReasonDeleted)
+		removed += 1
+	}
+	return removed
+}
+
+func (m *TTLMap) untag(mapEl *mapElement) {
+	for _, tag := range mapEl.tags {
+		keys := m.tags[tag]
+		delete(keys, mapEl.key)
+		if len(keys) == 0 {
+			delete(m.tags, tag)
+		}
+	}
+}
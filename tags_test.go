@@ -0,0 +1,56 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestInvalidateTag() {
+	clock := clockwork.NewFakeClock()
+	evicted := make(map[string]Reason)
+	m := newTTLMap(10, clock, WithOnEvict(func(key string, _ interface{}, reason Reason) {
+		evicted[key] = reason
+	}))
+
+	s.Require().Equal(nil, m.SetWithTags("a", 1, 10, "tenant-x"))
+	s.Require().Equal(nil, m.SetWithTags("b", 2, 10, "tenant-x", "tenant-y"))
+	s.Require().Equal(nil, m.SetWithTags("c", 3, 10, "tenant-y"))
+	s.Require().Equal(nil, m.SetWithTags("d", 4, 1, "tenant-x"))
+	s.Require().Equal(nil, m.SetWithTags("e", 5, 10, "tenant-x"))
+	s.Require().Equal(nil, m.Set("e", 5, 10))
+
+	clock.Advance(1 * time.Second)
+
+	s.Require().Equal(2, m.InvalidateTag("tenant-x"))
+	s.Require().Equal(map[string]Reason{
+		"a": ReasonDeleted,
+		"b": ReasonDeleted,
+		"d": ReasonExpired,
+	}, evicted)
+	s.Require().Equal(2, m.Len())
+
+	_, exists := m.Get("c")
+	s.Require().Equal(true, exists)
+	_, exists = m.Get("e")
+	s.Require().Equal(true, exists)
+
+	s.Require().Equal(1, m.InvalidateTag("tenant-y"))
+	s.Require().Equal(0, m.InvalidateTag("tenant-x"))
+	s.Require().Equal(0, len(m.tags))
+}
@@ -16,96 +16,1525 @@ limitations under the License.
 package ttlmap
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jonboulle/clockwork"
 )
 
+// ErrValueTooLarge is returned when a value exceeds the size
+// configured with WithMaxValueSize
+var ErrValueTooLarge = errors.New("value too large")
+
 type TTLMap struct {
+	// incremented on every access counted for PolicyLFU,
+	// first to be 64-bit aligned for atomic operations
+	accessTick int64
+
 	// Optionally specifies a callback function to be
-	// executed when an entry has expired
+	// executed when an entry has expired, after the map
+	// lock is released
+	//
+	// Deprecated: assigning the field while the map is in use races
+	// with expirations reading it, use SetOnExpire instead.
 	OnExpire func(key string, i interface{})
 
-	capacity    int
-	elements    map[string]*mapElement
-	expiryTimes *PriorityQueue
-	mutex       *sync.RWMutex
-	clock       clockwork.Clock
+	capacity    int
+	elements    map[string]*mapElement
+	expiryTimes *PriorityQueue
+	mutex       *sync.RWMutex
+
+	// tag to keys of entries carrying the tag
+	tags map[string]map[string]struct{}
+
+	// maximum and current total cost of the entries
+	maxCost   int
+	totalCost int
+	coster    func(interface{}) int
+
+	clockMutex sync.RWMutex
+	clock      clockwork.Clock
+
+	// bucket width in seconds entries expiry is rounded up to
+	ttlBucket int
+	// maximum fraction of the TTL it is randomly changed by
+	ttlJitter float64
+	// defers closing values until all acquired references are released
+	refCounting bool
+	onEvict     func(key string, value interface{}, reason Reason)
+	equal       func(a, b interface{}) bool
+	serveStale  bool
+	earlyBeta   float64
+	compression *compression
+	// encodes values written by WriteTo, gob is used if nil
+	persistCodec ValueCodec
+	// maximum value size and function computing the size of a value
+	maxValueSize int
+	sizer        func(interface{}) int
+	// sweep expired entries in background instead of inline
+	asyncSweeps bool
+	sweeping    bool
+	// only report entries above capacity instead of evicting them
+	softCapacity   bool
+	onOverCapacity func(overflow int)
+	onTTLExtended  func(key string, newExpiry time.Time)
+	tieBreaker     func(a, b Entry) bool
+	policy         EvictionPolicy
+	pinnedCount    int
+	lowWatermark   int
+	sliding        bool
+	defaultTTL     int
+	allowNoExpiry  bool
+	copier         func(interface{}) interface{}
+	expireSink     *expireSink
+	expireEvents   chan ExpireEvent
+	indexes        map[string]*secondaryIndex
+	onError        func(err error)
+	// measure lock waits reported by Stats
+	contentionMetrics bool
+	// entries removed and calls deferred while holding the lock, see unlock
+	removed  []removal
+	deferred []func()
+	// maximum expirations per second and expirations in the current second
+	expireRateLimit int
+	expireWindow    int
+	expireCount     int
+
+	stats *counters
+	// recent removals by reason and recent inserts
+	removals [ReasonDeleted + 1]eventRing
+	inserts  eventRing
+
+	randMutex sync.Mutex
+	// created on first use unless set by WithRandSource
+	rand *rand.Rand
+
+	// loads in progress by key, see GetOrCompute
+	loadsMutex sync.Mutex
+	loads      map[string]*load
+
+	cleanupMutex sync.Mutex
+	cleanupStop  chan struct{}
+	cleanupDone  chan struct{}
+	// set while the cleanup goroutine sweeps and executes callbacks
+	cleanupSweeping bool
+	// stops the cleanup once done
+	ctx context.Context
+}
+
+// Option configures optional TTLMap behavior
+type Option func(m *TTLMap)
+
+// WithTTLBuckets coalesces entries expiry times into n buckets spread
+// across maxTTLSeconds, so that entries expiring close to each other
+// share the same expiry and are swept together. Expiry is rounded up to
+// the next bucket boundary, hence an entry may be retained for up to
+// maxTTLSeconds/n seconds (rounded up) longer than requested. The bucket
+// width can not be derived from n alone, as TTLs are not known upfront,
+// so maxTTLSeconds gives the span the n buckets cover.
+func WithTTLBuckets(n int, maxTTLSeconds int) Option {
+	return func(m *TTLMap) {
+		if n <= 0 || maxTTLSeconds <= 0 {
+			return
+		}
+		m.ttlBucket = (maxTTLSeconds + n - 1) / n
+	}
+}
+
+// WithOnEvict sets a callback executed whenever an entry is removed
+// from the map along with the reason of the removal. The callback is
+// executed after the map lock is released, so it may access the map.
+func WithOnEvict(f func(key string, value interface{}, reason Reason)) Option {
+	return func(m *TTLMap) {
+		m.onEvict = f
+	}
+}
+
+// WithOnTTLExtended sets a callback executed whenever an entry's TTL
+// is prolonged, e.g. by GetAndTouch, after the map lock is released.
+// newExpiry is the zero time if the entry no longer expires.
+func WithOnTTLExtended(f func(key string, newExpiry time.Time)) Option {
+	return func(m *TTLMap) {
+		m.onTTLExtended = f
+	}
+}
+
+// WithEqualFunc sets the function used to compare values, e.g. by
+// CompareAndSwap. By default values are compared with ==, falling back
+// to reflect.DeepEqual for types that are not comparable.
+func WithEqualFunc(equal func(a, b interface{}) bool) Option {
+	return func(m *TTLMap) {
+		m.equal = equal
+	}
+}
+
+// WithServeStaleUntilWrite makes Get return expired values until the key
+// is written again or evicted. Use GetFresh to tell stale values apart.
+// Expired entries are still removed by RemoveExpired and the cleanup.
+func WithServeStaleUntilWrite() Option {
+	return func(m *TTLMap) {
+		m.serveStale = true
+	}
+}
+
+// WithProbabilisticEarlyExpiry makes Get report a miss for entries
+// nearing their expiry with increasing probability (XFetch), so that a
+// single caller refreshes the value before it actually expires.
+// The recompute cost is estimated as beta times the entry's TTL, e.g. with
+// beta of 0.1 an early miss becomes likely within the last tenth of the TTL.
+// With WithServeStaleUntilWrite the value is returned as not fresh instead.
+func WithProbabilisticEarlyExpiry(beta float64) Option {
+	return func(m *TTLMap) {
+		m.earlyBeta = beta
+	}
+}
+
+// WithMaxValueSize rejects values larger than bytes as reported by sizer
+// with ErrValueTooLarge. If sizer is nil the size of []byte and string
+// values is their length and other values are not limited.
+func WithMaxValueSize(bytes int, sizer func(interface{}) int) Option {
+	return func(m *TTLMap) {
+		if sizer == nil {
+			sizer = defaultSizer
+		}
+		m.maxValueSize = bytes
+		m.sizer = sizer
+	}
+}
+
+// WithSoftCapacity disables capacity eviction, the map grows beyond its
+// capacity and the overflow is reported by OverCapacity and the callback
+// set with WithOnOverCapacity. Expired entries are still removed.
+func WithSoftCapacity() Option {
+	return func(m *TTLMap) {
+		m.softCapacity = true
+	}
+}
+
+// WithOnOverCapacity sets a callback executed whenever an insert leaves
+// the map with more entries than its capacity, after the map lock is
+// released
+func WithOnOverCapacity(f func(overflow int)) Option {
+	return func(m *TTLMap) {
+		m.onOverCapacity = f
+	}
+}
+
+// WithSlidingExpiration makes Get and GetInt reset the TTL of the entry
+// they read to the TTL it was stored with, so that entries only expire
+// once they are not read for that long
+func WithSlidingExpiration() Option {
+	return func(m *TTLMap) {
+		m.sliding = true
+	}
+}
+
+// noExpiry is the expiry time of entries that never expire
+const noExpiry = math.MaxInt
+
+// WithNoExpiry makes a TTL of 0 store entries that never expire. Such
+// entries are only removed explicitly or, once no other entries are left
+// to evict, by capacity eviction.
+func WithNoExpiry() Option {
+	return func(m *TTLMap) {
+		m.allowNoExpiry = true
+	}
+}
+
+// WithDefaultTTL sets the TTL applied by SetDefault
+func WithDefaultTTL(ttlSeconds int) Option {
+	return func(m *TTLMap) {
+		m.defaultTTL = ttlSeconds
+	}
+}
+
+// WithCopyOnGet makes Get and the other lookups return copier(value)
+// instead of the stored value, so that callers mutating the returned
+// value don't affect the cached one
+func WithCopyOnGet(copier func(interface{}) interface{}) Option {
+	return func(m *TTLMap) {
+		m.copier = copier
+	}
+}
+
+// WithExpireRateLimit limits the number of expired entries removed per
+// second as measured by the map clock, deferring the rest to subsequent
+// sweeps. Entries awaiting removal are still invisible to Get. Entries
+// evicted to free space for inserts are not limited.
+func WithExpireRateLimit(perSecond int) Option {
+	return func(m *TTLMap) {
+		m.expireRateLimit = perSecond
+	}
+}
+
+// WithMaxEntries limits the number of entries in the map,
+// it is equivalent to the capacity passed to NewTTLMap
+func WithMaxEntries(n int) Option {
+	return func(m *TTLMap) {
+		if n > 0 {
+			m.capacity = n
+		}
+	}
+}
+
+// WithEvictionHysteresis makes the map hold up to high entries and, once
+// an insert finds it full, evict entries in one go until low entries are
+// left including the new one, so that inserts following the eviction
+// don't evict. It replaces the capacity passed to NewTTLMap.
+func WithEvictionHysteresis(low, high int) Option {
+	return func(m *TTLMap) {
+		if low <= 0 || low > high {
+			return
+		}
+		m.capacity = high
+		m.lowWatermark = low
+	}
+}
+
+// WithMaxCost limits the total cost of the entries in the map as reported
+// by sizer, evicting entries on insert until both the cost and the entries
+// count limits are met. Values costing more than max are rejected with
+// ErrValueTooLarge. If sizer is nil the cost of []byte and string values is
+// their length and other values cost nothing. Compressed values cost their
+// compressed length.
+func WithMaxCost(max int, sizer func(interface{}) int) Option {
+	return func(m *TTLMap) {
+		if sizer == nil {
+			sizer = defaultSizer
+		}
+		m.maxCost = max
+		m.coster = sizer
+	}
+}
+
+// WithEvictionTieBreaker sets the function ordering entries with the
+// same expiry time for eviction, the entry for which less reports true
+// is evicted first. By default such entries are evicted in key order.
+// less is called under the map lock on every comparison, so values
+// compressed by WithValueCompression are not decompressed for it and
+// their Value is nil.
+func WithEvictionTieBreaker(less func(a, b Entry) bool) Option {
+	return func(m *TTLMap) {
+		m.tieBreaker = less
+	}
+}
+
+// WithTTLJitter randomly lengthens or shortens the TTL of every stored
+// entry by up to fraction of it, e.g. by up to 10% for 0.1, rounded to
+// whole seconds and to at least a second, so that entries stored at the
+// same time with the same TTL don't all expire at once. Fraction is
+// capped to 1, the randomness comes from WithRandSource.
+func WithTTLJitter(fraction float64) Option {
+	return func(m *TTLMap) {
+		m.ttlJitter = math.Min(fraction, 1)
+	}
+}
+
+// WithRandSource sets the source of randomness used by the map,
+// e.g. to make jittered cleanup deterministic in tests
+func WithRandSource(src rand.Source) Option {
+	return func(m *TTLMap) {
+		m.rand = rand.New(src)
+	}
+}
+
+// WithClock sets the clock used to compute and check expiry times,
+// e.g. a fake clock to control expiry deterministically in tests
+func WithClock(clock clockwork.Clock) Option {
+	return func(m *TTLMap) {
+		m.clock = clock
+	}
+}
+
+// Reason describes why an entry was removed from the map
+type Reason int
+
+const (
+	// ReasonExpired means the entry's TTL has lapsed
+	ReasonExpired Reason = iota + 1
+	// ReasonCapacity means the entry was evicted to free space
+	ReasonCapacity
+	// ReasonDeleted means the entry was explicitly removed
+	ReasonDeleted
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonExpired:
+		return "expired"
+	case ReasonCapacity:
+		return "capacity"
+	case ReasonDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("Reason(%d)", int(r))
+}
+
+type mapElement struct {
+	// number of reads and the access tick of the last read or write, which
+	// is only tracked with PolicyLFU, first to be 64-bit aligned
+	accesses   int64
+	lastAccess int64
+
+	key    string
+	value  interface{}
+	heapEl *PQItem
+	closer *closerRef
+	// ttl in seconds the entry was stored with
+	ttl  int
+	tags []string
+	cost int
+	meta map[string]string
+	// secondary index name to the key the entry is indexed under
+	secondary map[string]string
+	// protected from capacity eviction
+	pinned bool
+	// cost was set with SetWithWeight instead of computed from the value
+	weighted bool
+}
+
+// maxPrealloc caps the number of entries space is preallocated for,
+// so that a huge capacity does not allocate memory upfront
+const maxPrealloc = 1024
+
+func NewTTLMap(capacity int, opts ...Option) *TTLMap {
+	if capacity <= 0 {
+		capacity = 0
+	}
+	prealloc := capacity
+	if prealloc > maxPrealloc {
+		prealloc = maxPrealloc
+	}
+
+	m := &TTLMap{
+		capacity: capacity,
+		elements: make(map[string]*mapElement, prealloc),
+		tags:     make(map[string]map[string]struct{}),
+		mutex:    &sync.RWMutex{},
+		clock:    clockwork.NewRealClock(),
+		equal:    defaultEqual,
+		stats:    &counters{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.expiryTimes = newPriorityQueue(m.breakTie)
+	return m
+}
+
+// NewTTLMapChecked is like NewTTLMap, but errors on a negative capacity
+// instead of treating it as zero
+func NewTTLMapChecked(capacity int, opts ...Option) (*TTLMap, error) {
+	if capacity < 0 {
+		return nil, fmt.Errorf("capacity should be >= 0, got %d", capacity)
+	}
+	return NewTTLMap(capacity, opts...), nil
+}
+
+// SetOnExpire replaces the callback executed when an entry has expired.
+// It is safe to call while the map is in use.
+func (m *TTLMap) SetOnExpire(f func(key string, value interface{})) {
+	m.lock()
+	defer m.unlock()
+	m.OnExpire = f
+}
+
+func (m *TTLMap) Set(key string, value interface{}, ttlSeconds int) error {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return err
+	}
+	value, err = m.prepareValue(value)
+	if err != nil {
+		return err
+	}
+	m.lock()
+	defer m.unlock()
+	return m.set(key, value, expiryTime)
+}
+
+// MSet stores the entries under one lock and evicts entries to fit the
+// capacity once all are stored. If an entry has an invalid TTL or value,
+// MSet returns the error without storing any entry. If the entries don't
+// fit because the others are pinned, they are stored and ErrFull is
+// returned.
+func (m *TTLMap) MSet(entries []Entry) error {
+	expiryTimes := make([]int, len(entries))
+	values := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		expiryTime, err := m.toEpochSeconds(entry.TTLSeconds)
+		if err != nil {
+			return err
+		}
+		value, err := m.prepareValue(entry.Value)
+		if err != nil {
+			return err
+		}
+		if m.maxCost > 0 && m.costOf(value) > m.maxCost {
+			return ErrValueTooLarge
+		}
+		expiryTimes[i], values[i] = expiryTime, value
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	for i, entry := range entries {
+		m.insert(entry.Key, values[i], expiryTimes[i], m.costOf(values[i]), false)
+	}
+	return m.shrink()
+}
+
+// Swap is like Set but also returns the value of the live entry it
+// replaced, had is false if there was no such entry
+func (m *TTLMap) Swap(key string, value interface{}, ttlSeconds int) (previous interface{}, had bool, err error) {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return nil, false, err
+	}
+	value, err = m.prepareValue(value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	if mapEl, expired := m.get(key); mapEl != nil && !expired {
+		previous, had = m.valueOf(mapEl)
+	}
+	if err := m.set(key, value, expiryTime); err != nil {
+		return nil, false, err
+	}
+	return previous, had, nil
+}
+
+// SetIfAbsent stores the value only if there is no live entry under key
+// and reports whether it was stored
+func (m *TTLMap) SetIfAbsent(key string, value interface{}, ttlSeconds int) (bool, error) {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return false, err
+	}
+	value, err = m.prepareValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	m.lock()
+	defer m.unlock()
+	return m.setIfAbsent(key, value, expiryTime)
+}
+
+// GetOrSet returns the value of the live entry stored under key with
+// loaded set to true, otherwise it stores value and returns it
+func (m *TTLMap) GetOrSet(key string, value interface{}, ttlSeconds int) (actual interface{}, loaded bool, err error) {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return nil, false, err
+	}
+	prepared, err := m.prepareValue(value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	if mapEl, expired := m.get(key); mapEl != nil && !expired {
+		if current, ok := m.valueOf(mapEl); ok {
+			atomic.AddInt64(&m.stats.hits, 1)
+			return m.copyValue(current), true, nil
+		}
+	}
+	atomic.AddInt64(&m.stats.misses, 1)
+	if err := m.set(key, prepared, expiryTime); err != nil {
+		return nil, false, err
+	}
+	return value, false, nil
+}
+
+// SetDefault is like Set with the TTL configured by WithDefaultTTL,
+// it errors if no default TTL is configured
+func (m *TTLMap) SetDefault(key string, value interface{}) error {
+	if m.defaultTTL == 0 {
+		return fmt.Errorf("no default TTL is configured")
+	}
+	return m.Set(key, value, m.defaultTTL)
+}
+
+// SetExpireAt stores the value to expire at the given absolute time.
+// Expiry has one second resolution, sub-second deadlines are rounded up.
+func (m *TTLMap) SetExpireAt(key string, value interface{}, expireAt time.Time) error {
+	if !expireAt.After(m.getClock().Now()) {
+		return wrapf(ErrInvalidTTL, "expireAt should be in the future, got %v", expireAt)
+	}
+	expiryTime := expireAt.Unix()
+	if expireAt.Nanosecond() > 0 {
+		expiryTime += 1
+	}
+	value, err := m.prepareValue(value)
+	if err != nil {
+		return err
+	}
+	m.lock()
+	defer m.unlock()
+	return m.set(key, value, int(expiryTime))
+}
+
+// SetExpiry is the same as SetExpireAt
+func (m *TTLMap) SetExpiry(key string, value interface{}, expiry time.Time) error {
+	return m.SetExpireAt(key, value, expiry)
+}
+
+// TTLUntil returns the TTL in seconds, rounded up, keeping an entry
+// until deadline as measured by the map clock
+func (m *TTLMap) TTLUntil(deadline time.Time) (int, error) {
+	ttl := deadline.Sub(m.getClock().Now())
+	if ttl <= 0 {
+		return 0, wrapf(ErrInvalidTTL, "deadline should be in the future, got %v", deadline)
+	}
+	return int((ttl + time.Second - 1) / time.Second), nil
+}
+
+// SetClock replaces the clock used by the map. If rebaseExpiry is true
+// entries keep their remaining TTL as measured by the new clock, otherwise
+// their absolute expiry times are kept.
+func (m *TTLMap) SetClock(clock clockwork.Clock, rebaseExpiry bool) {
+	m.lock()
+	defer m.unlock()
+
+	m.clockMutex.Lock()
+	offset := int(clock.Now().Unix() - m.clock.Now().Unix())
+	m.clock = clock
+	m.clockMutex.Unlock()
+
+	if !rebaseExpiry {
+		return
+	}
+	// Shifting all expiry times by the same offset keeps the heap order
+	for _, mapEl := range m.elements {
+		if mapEl.heapEl.Priority != noExpiry {
+			mapEl.heapEl.Priority += offset
+		}
+	}
+}
+
+// Reset removes all entries without reporting them as removals, replaces
+// the capacity and the clock and zeroes the stats counters. Options and
+// callbacks the map was created with are kept.
+func (m *TTLMap) Reset(capacity int, clock clockwork.Clock) {
+	m.lock()
+	defer m.unlock()
+
+	for _, mapEl := range m.elements {
+		if mapEl.closer != nil {
+			m.releaseCloser(mapEl.closer)
+		}
+	}
+	if capacity <= 0 {
+		capacity = 0
+	}
+	m.capacity = capacity
+	m.elements = make(map[string]*mapElement)
+	m.tags = make(map[string]map[string]struct{})
+	for _, index := range m.indexes {
+		index.keys = make(map[string]map[string]struct{})
+	}
+	m.expiryTimes = newPriorityQueue(m.breakTie)
+	m.totalCost = 0
+	m.pinnedCount = 0
+	m.expireWindow = 0
+	m.expireCount = 0
+	m.removals = [ReasonDeleted + 1]eventRing{}
+	m.inserts = eventRing{}
+	m.stats.reset()
+
+	m.clockMutex.Lock()
+	m.clock = clock
+	m.clockMutex.Unlock()
+}
+
+func (m *TTLMap) getClock() clockwork.Clock {
+	m.clockMutex.RLock()
+	defer m.clockMutex.RUnlock()
+	return m.clock
+}
+
+// Len returns the number of live entries, entries that expired but are
+// not removed yet are not counted
+func (m *TTLMap) Len() int {
+	m.rLock()
+	defer m.rUnlock()
+	now := int(m.getClock().Now().Unix())
+	return len(m.elements) - m.expiryTimes.countUpTo(now)
+}
+
+// RawLen returns the number of entries held by the map,
+// including expired entries that are not removed yet
+func (m *TTLMap) RawLen() int {
+	m.rLock()
+	defer m.rUnlock()
+	return len(m.elements)
+}
+
+// SetCapacity changes the map capacity. If the map holds more entries
+// than the new capacity, expired entries and then the entries closest to
+// their expiry are evicted right away until it fits.
+func (m *TTLMap) SetCapacity(capacity int) error {
+	if capacity < 1 {
+		return fmt.Errorf("capacity should be >= 1, got %d", capacity)
+	}
+	m.lock()
+	defer m.unlock()
+
+	m.capacity = capacity
+	if overflow := len(m.elements) - capacity; overflow > 0 && !m.softCapacity {
+		m.freeSpace(overflow)
+	}
+	return nil
+}
+
+// OverCapacity returns the number of entries above the map capacity,
+// which is only possible with WithSoftCapacity
+func (m *TTLMap) OverCapacity() int {
+	m.rLock()
+	defer m.rUnlock()
+	if overflow := len(m.elements) - m.capacity; overflow > 0 {
+		return overflow
+	}
+	return 0
+}
+
+// WouldEvict reports whether storing a new entry under key would remove
+// another entry to make room for it and returns the key of that entry.
+// The victim may be an entry that has already expired. Cost limits set
+// by WithMaxCost are not taken into account.
+func (m *TTLMap) WouldEvict(key string) (bool, string) {
+	// Looking past pinned entries reorders the expiry queue
+	m.lock()
+	defer m.unlock()
+
+	if _, ok := m.elements[key]; ok {
+		return false, ""
+	}
+	if m.softCapacity || len(m.elements) < m.capacity {
+		return false, ""
+	}
+	victim := m.evictionVictim(int(m.getClock().Now().Unix()))
+	if victim == nil {
+		return false, ""
+	}
+	return true, victim.key
+}
+
+func (m *TTLMap) Get(key string) (interface{}, bool) {
+	value, _, exists := m.GetFresh(key)
+	return value, exists
+}
+
+// GetMulti looks up the keys under one lock and returns the values of
+// the live entries found, missing and expired keys are left out
+func (m *TTLMap) GetMulti(keys []string) map[string]interface{} {
+	values := make(map[string]interface{}, len(keys))
+	var expired []*mapElement
+	var errs []error
+	m.rLock()
+	for _, key := range keys {
+		mapEl, isExpired := m.get(key)
+		if mapEl == nil {
+			continue
+		}
+		if isExpired {
+			expired = append(expired, mapEl)
+			continue
+		}
+		value, err := m.decodeValue(mapEl)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		values[key] = value
+		m.countAccess(mapEl)
+	}
+	m.rUnlock()
+
+	m.notifyErrors(errs...)
+	for _, mapEl := range expired {
+		m.lockNDel(mapEl)
+	}
+	atomic.AddInt64(&m.stats.hits, int64(len(values)))
+	atomic.AddInt64(&m.stats.misses, int64(len(keys)-len(values)))
+	for key, value := range values {
+		values[key] = m.copyValue(value)
+	}
+	return values
+}
+
+// GetWithTTL is like Get but also returns the time left until the entry
+// expires as measured by the map clock, or 0 if the entry never expires
+func (m *TTLMap) GetWithTTL(key string) (interface{}, time.Duration, bool) {
+	m.rLock()
+	mapEl, expired := m.get(key)
+	var value interface{}
+	var ttl time.Duration
+	var err error
+	if mapEl != nil && !expired {
+		value, err = m.decodeValue(mapEl)
+		if mapEl.heapEl.Priority != noExpiry {
+			ttl = mapEl.expiresAt().Sub(m.getClock().Now())
+		}
+	}
+	m.rUnlock()
+
+	m.notifyErrors(err)
+	if mapEl == nil || expired || err != nil {
+		atomic.AddInt64(&m.stats.misses, 1)
+		if expired {
+			m.lockNDel(mapEl)
+		}
+		return nil, 0, false
+	}
+	atomic.AddInt64(&m.stats.hits, 1)
+	m.countAccess(mapEl)
+	return m.copyValue(value), ttl, true
+}
+
+// Peek returns the value stored under key without affecting the map,
+// it is not counted in Stats and doesn't remove the entry if expired
+func (m *TTLMap) Peek(key string) (interface{}, bool) {
+	m.rLock()
+	mapEl, expired := m.get(key)
+	var value interface{}
+	var err error
+	if mapEl != nil && !expired {
+		value, err = m.decodeValue(mapEl)
+	}
+	m.rUnlock()
+
+	m.notifyErrors(err)
+	if mapEl == nil || expired || err != nil {
+		return nil, false
+	}
+	return m.copyValue(value), true
+}
+
+// GetFresh is like Get but also reports whether the value is fresh,
+// i.e. not expired. Expired values are only returned when the map
+// was created with WithServeStaleUntilWrite.
+func (m *TTLMap) GetFresh(key string) (value interface{}, fresh bool, exists bool) {
+	value, _, fresh, exists = m.getFresh(key)
+	return value, fresh, exists
+}
+
+func (m *TTLMap) getFresh(key string) (value interface{}, mapEl *mapElement, fresh bool, exists bool) {
+	value, mapEl, expired, err := m.lockNGet(key)
+	m.notifyErrors(err)
+	if mapEl == nil || err != nil {
+		atomic.AddInt64(&m.stats.misses, 1)
+		return nil, nil, false, false
+	}
+	if expired {
+		if m.serveStale {
+			atomic.AddInt64(&m.stats.hits, 1)
+			return m.copyValue(value), mapEl, false, true
+		}
+		atomic.AddInt64(&m.stats.misses, 1)
+		m.lockNDel(mapEl)
+		return nil, nil, false, false
+	}
+	atomic.AddInt64(&m.stats.hits, 1)
+	m.countAccess(mapEl)
+	if m.sliding {
+		m.lockNSlide(key)
+	}
+	return m.copyValue(value), mapEl, true, true
+}
+
+// lockNSlide resets the TTL of the entry read with sliding expiration
+func (m *TTLMap) lockNSlide(key string) {
+	m.lock()
+	defer m.unlock()
+
+	mapEl, expired := m.get(key)
+	if mapEl == nil || expired || mapEl.heapEl.Priority == noExpiry {
+		return
+	}
+	m.touch(mapEl, int(m.getClock().Now().Unix())+mapEl.ttl)
+}
+
+func (m *TTLMap) Increment(key string, value int, ttlSeconds int) (int, error) {
+	count, _, _, err := m.increment(key, value, ttlSeconds, nil, false)
+	return count, err
+}
+
+// Decrement subtracts value from the counter stored under key and resets
+// its TTL like Increment, a missing counter is created at -value. It also
+// reports whether the counter existed.
+func (m *TTLMap) Decrement(key string, value int, ttlSeconds int) (int, bool, error) {
+	count, _, existed, err := m.increment(key, -value, ttlSeconds, nil, false)
+	return count, existed, err
+}
+
+// IncrementCapped is like Increment but never stores a value above max,
+// the resulting value saturates at max instead
+func (m *TTLMap) IncrementCapped(key string, value, ttlSeconds, max int) (int, error) {
+	count, _, _, err := m.increment(key, value, ttlSeconds, &max, false)
+	return count, err
+}
+
+// IncrementWindow increments the counter stored under key within a fixed
+// window. The first increment starts a window of windowSeconds, later
+// increments keep its deadline, so the counter starts over once the window
+// has passed. It returns the counter and the time the window resets at.
+func (m *TTLMap) IncrementWindow(key string, value, windowSeconds int) (int, time.Time, error) {
+	count, expiryTime, _, err := m.increment(key, value, windowSeconds, nil, true)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return count, time.Unix(int64(expiryTime), 0), nil
+}
+
+func (m *TTLMap) increment(key string, value int, ttlSeconds int, max *int, keepExpiry bool) (int, int, bool, error) {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	currentValue := 0
+	mapEl, expired := m.get(key)
+	existed := mapEl != nil && !expired
+	if existed {
+		var ok bool
+		currentValue, ok = mapEl.value.(int)
+		if !ok {
+			current, _ := m.decodeValue(mapEl)
+			return 0, 0, false, wrapf(ErrWrongType, "Expected existing value to be integer, got %T", current)
+		}
+		if keepExpiry {
+			expiryTime = mapEl.heapEl.Priority
+		}
+	}
+
+	currentValue += value
+	if max != nil && currentValue > *max {
+		currentValue = *max
+	}
+	if err := m.checkValueSize(currentValue); err != nil {
+		return 0, 0, false, err
+	}
+	if err := m.set(key, currentValue, expiryTime); err != nil {
+		return 0, 0, false, err
+	}
+	return currentValue, expiryTime, existed, nil
+}
+
+// Remove deletes the entry stored under key and returns its value,
+// it returns false if there is no such entry or its value fails to
+// decode. OnExpire is not executed for removed entries.
+func (m *TTLMap) Remove(key string) (interface{}, bool) {
+	m.lock()
+	defer m.unlock()
+
+	mapEl, expired := m.get(key)
+	if mapEl == nil {
+		return nil, false
+	}
+	if expired {
+		m.removeElement(mapEl, ReasonExpired)
+		return nil, false
+	}
+	value, ok := m.valueOf(mapEl)
+	m.removeElement(mapEl, ReasonDeleted)
+	return value, ok
+}
+
+// GetAndDelete returns the live value stored under key and removes the
+// entry under one lock, so that only one of concurrent callers gets it,
+// e.g. to consume one-shot tokens. It is the same as Remove.
+func (m *TTLMap) GetAndDelete(key string) (interface{}, bool) {
+	return m.Remove(key)
+}
+
+// RemovePrefix removes all entries whose keys start with prefix and
+// returns the number of live entries removed. Like with Remove, OnExpire
+// is not executed for them. Expired entries are removed as expired.
+func (m *TTLMap) RemovePrefix(prefix string) int {
+	m.lock()
+	defer m.unlock()
+
+	removed := 0
+	for key, mapEl := range m.elements {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if _, expired := m.get(key); expired {
+			m.removeElement(mapEl, ReasonExpired)
+			continue
+		}
+		m.removeElement(mapEl, ReasonDeleted)
+		removed += 1
+	}
+	return removed
+}
+
+// Clear removes all entries, keeping the capacity, callbacks and stats.
+// Like with Remove, OnExpire is not executed for cleared entries, the
+// WithOnEvict callback is executed with ReasonDeleted.
+func (m *TTLMap) Clear() {
+	m.lock()
+	defer m.unlock()
+
+	for _, mapEl := range m.elements {
+		m.removeElement(mapEl, ReasonDeleted)
+	}
+}
+
+// Touch resets the TTL of the entry stored under key without changing
+// its value, it returns false if there is no such entry
+func (m *TTLMap) Touch(key string, ttlSeconds int) (bool, error) {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return false, err
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	mapEl, expired := m.get(key)
+	if mapEl == nil || expired {
+		return false, nil
+	}
+	m.touch(mapEl, expiryTime)
+	return true, nil
+}
+
+// GetAndTouch returns the value stored under key and resets its TTL
+// in one atomic operation
+func (m *TTLMap) GetAndTouch(key string, ttlSeconds int) (interface{}, bool, error) {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return nil, false, err
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	mapEl, expired := m.get(key)
+	if mapEl == nil || expired {
+		return nil, false, nil
+	}
+	value, ok := m.valueOf(mapEl)
+	if !ok {
+		return nil, false, nil
+	}
+	m.touch(mapEl, expiryTime)
+	return m.copyValue(value), true, nil
+}
+
+// ContainsAll reports for each of the keys whether it is present
+// and not expired, without affecting the entries
+func (m *TTLMap) ContainsAll(keys []string) map[string]bool {
+	m.rLock()
+	defer m.rUnlock()
+
+	contains := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		mapEl, expired := m.get(key)
+		contains[key] = mapEl != nil && !expired
+	}
+	return contains
+}
+
+// CompareAndSwap replaces the value stored under key with newValue and
+// updates its TTL only if the key exists and its value equals oldValue
+func (m *TTLMap) CompareAndSwap(key string, oldValue, newValue interface{}, ttlSeconds int) (bool, error) {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return false, err
+	}
+	newValue, err = m.prepareValue(newValue)
+	if err != nil {
+		return false, err
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	mapEl, expired := m.get(key)
+	if mapEl == nil || expired {
+		return false, nil
+	}
+	if current, ok := m.valueOf(mapEl); !ok || !m.equal(current, oldValue) {
+		return false, nil
+	}
+	return true, m.set(key, newValue, expiryTime)
+}
+
+// MoveTo removes the entry stored under key and stores it in dst with its
+// remaining TTL, tags, metadata, pin and closer, whose ownership passes to
+// dst. It returns false if there is no such entry or dst rejects it, in
+// which case the entry is put back unless key was stored meanwhile. The
+// entry is removed atomically with respect to m, however the maps are
+// never locked at the same time, so that concurrent moves in opposite
+// directions can not deadlock.
+func (m *TTLMap) MoveTo(dst *TTLMap, key string) bool {
+	if dst == m {
+		_, exists := m.Get(key)
+		return exists
+	}
+
+	m.lock()
+	mapEl, expired := m.get(key)
+	if mapEl == nil || expired {
+		m.unlock()
+		return false
+	}
+	value, ok := m.valueOf(mapEl)
+	if !ok {
+		m.unlock()
+		return false
+	}
+	ttlSeconds := ttlOf(mapEl.heapEl.Priority, int(m.getClock().Now().Unix()))
+	m.unlink(mapEl)
+	m.unlock()
+
+	if dst.adopt(mapEl, value, ttlSeconds) {
+		return true
+	}
+
+	m.lock()
+	defer m.unlock()
+	if _, ok := m.elements[key]; !ok {
+		m.link(mapEl)
+	} else if mapEl.closer != nil {
+		m.releaseCloser(mapEl.closer)
+	}
+	return false
+}
+
+// adopt stores the value of an entry moved from another map along with its
+// tags, metadata, pin and closer, it returns false if the value is rejected
+func (m *TTLMap) adopt(moved *mapElement, value interface{}, ttlSeconds int) bool {
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return false
+	}
+	prepared, err := m.prepareValue(value)
+	if err != nil {
+		return false
+	}
+
+	m.lock()
+	defer m.unlock()
+	if err := m.set(moved.key, prepared, expiryTime); err != nil {
+		return false
+	}
+	mapEl := m.elements[moved.key]
+	mapEl.meta = moved.meta
+	mapEl.closer = moved.closer
+	m.tag(mapEl, moved.tags)
+	if moved.pinned && !mapEl.pinned {
+		mapEl.pinned = true
+		m.pinnedCount += 1
+	}
+	return true
+}
+
+// Merge stores the live entries of other with their remaining TTL as
+// measured by the clock of other, so both maps should use the same clock.
+// Entries colliding with live entries of m replace them only if overwrite
+// is true. Capacity eviction of m applies once all are stored, as with
+// MSet. If a value is rejected, Merge returns the error without storing
+// any entry. The maps are never locked at the same time.
+func (m *TTLMap) Merge(other *TTLMap, overwrite bool) error {
+	if other == m {
+		return nil
+	}
+	otherNow := other.getClock().Now().Unix()
+	entries, err := other.persistedEntries()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		value, err := m.prepareValue(entry.Value)
+		if err != nil {
+			return err
+		}
+		if m.maxCost > 0 && m.costOf(value) > m.maxCost {
+			return ErrValueTooLarge
+		}
+		values[i] = value
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	now := m.getClock().Now().Unix()
+	for i, entry := range entries {
+		if mapEl, expired := m.get(entry.Key); mapEl != nil && !expired && !overwrite {
+			continue
+		}
+		expiryTime := noExpiry
+		if entry.ExpiresAt != 0 {
+			expiryTime = int(now + entry.ExpiresAt - otherNow)
+		}
+		m.insert(entry.Key, values[i], expiryTime, m.costOf(values[i]), false)
+	}
+	return m.shrink()
 }
 
-type mapElement struct {
-	key    string
-	value  interface{}
-	heapEl *PQItem
+// UpdateAll calls fn for every live entry under one lock and replaces the
+// entry value with the one fn returns, keeping its TTL, or removes the
+// entry if fn returns false. Values that fail to be stored, e.g. because
+// they exceed WithMaxValueSize, are reported to the WithOnError function
+// and the entry keeps its previous value.
+func (m *TTLMap) UpdateAll(fn func(key string, value interface{}) (interface{}, bool)) {
+	m.lock()
+	defer m.unlock()
+
+	now := int(m.getClock().Now().Unix())
+	for _, mapEl := range m.elements {
+		if mapEl.heapEl.Priority <= now {
+			continue
+		}
+		value, ok := m.valueOf(mapEl)
+		if !ok {
+			continue
+		}
+		newValue, keep := fn(mapEl.key, value)
+		if !keep {
+			m.removeElement(mapEl, ReasonDeleted)
+			continue
+		}
+		newValue, err := m.prepareValue(newValue)
+		if err != nil {
+			m.reportError(err)
+			continue
+		}
+		m.unindex(mapEl)
+		if !mapEl.weighted {
+			cost := m.costOf(newValue)
+			m.totalCost += cost - mapEl.cost
+			mapEl.cost = cost
+		}
+		mapEl.value = newValue
+		m.index(mapEl)
+	}
 }
 
-func NewTTLMap(capacity int) *TTLMap {
-	if capacity <= 0 {
-		capacity = 0
+// Entry is a key and value to be stored with the given TTL
+type Entry struct {
+	Key        string
+	Value      interface{}
+	TTLSeconds int
+}
+
+// LoadFrom stores entries received from ch until it is closed and returns
+// the number of entries stored. Entries with an invalid TTL or value are
+// skipped. Capacity eviction applies as with Set.
+func (m *TTLMap) LoadFrom(ch <-chan Entry) int {
+	count := 0
+	for entry := range ch {
+		if err := m.Set(entry.Key, entry.Value, entry.TTLSeconds); err != nil {
+			continue
+		}
+		count += 1
 	}
+	return count
+}
+
+// EntryWithTTL is a map entry along with its remaining TTL
+type EntryWithTTL struct {
+	Key   string
+	Value interface{}
+	TTL   time.Duration
+}
+
+// EntriesWithTTL returns all live entries along with their remaining TTL
+// captured in one consistent pass, or 0 for entries that never expire.
+// The order is unspecified.
+func (m *TTLMap) EntriesWithTTL() []EntryWithTTL {
+	var errs []error
+	m.rLock()
+	defer func() {
+		m.rUnlock()
+		m.notifyErrors(errs...)
+	}()
 
-	return &TTLMap{
-		capacity:    capacity,
-		elements:    make(map[string]*mapElement),
-		expiryTimes: NewPriorityQueue(),
-		mutex:       &sync.RWMutex{},
-		clock:       clockwork.NewRealClock(),
+	now := m.getClock().Now()
+	entries := make([]EntryWithTTL, 0, len(m.elements))
+	for _, mapEl := range m.elements {
+		ttl := mapEl.remaining(now)
+		if ttl <= 0 {
+			continue
+		}
+		if ttl == TTLOverflow {
+			ttl = 0
+		}
+		value, err := m.decodeValue(mapEl)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		entries = append(entries, EntryWithTTL{
+			Key:   mapEl.key,
+			Value: value,
+			TTL:   ttl,
+		})
 	}
+	return entries
 }
 
-func (m *TTLMap) Set(key string, value interface{}, ttlSeconds int) error {
-	expiryTime, err := m.toEpochSeconds(ttlSeconds)
-	if err != nil {
-		return err
+// String renders the live entries sorted by key along with their
+// remaining TTL, e.g. ttlmap(len=2/cap=10){a=1(ttl=3s) b=2(ttl=7s)}
+func (m *TTLMap) String() string {
+	var errs []error
+	m.rLock()
+	defer func() {
+		m.rUnlock()
+		m.notifyErrors(errs...)
+	}()
+
+	now := m.getClock().Now()
+	live := m.liveElements(int(now.Unix()))
+	sort.Slice(live, func(i, j int) bool { return live[i].key < live[j].key })
+	entries := make([]string, 0, len(live))
+	for _, mapEl := range live {
+		value, err := m.decodeValue(mapEl)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ttl := "never"
+		if mapEl.heapEl.Priority != noExpiry {
+			ttl = mapEl.expiresAt().Sub(now).String()
+		}
+		entries = append(entries, fmt.Sprintf("%s=%v(ttl=%s)", mapEl.key, value, ttl))
 	}
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	return m.set(key, value, expiryTime)
+	return fmt.Sprintf("ttlmap(len=%d/cap=%d){%s}", len(entries), m.capacity, strings.Join(entries, " "))
 }
 
-func (m *TTLMap) Len() int {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
-	return len(m.elements)
+// Dump returns the keys and values of all live entries
+func (m *TTLMap) Dump() map[string]interface{} {
+	var errs []error
+	m.rLock()
+	defer func() {
+		m.rUnlock()
+		m.notifyErrors(errs...)
+	}()
+
+	live := m.liveElements(int(m.getClock().Now().Unix()))
+	dump := make(map[string]interface{}, len(live))
+	for _, mapEl := range live {
+		value, err := m.decodeValue(mapEl)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		dump[mapEl.key] = m.copyValue(value)
+	}
+	return dump
 }
 
-func (m *TTLMap) Get(key string) (interface{}, bool) {
-	value, mapEl, expired := m.lockNGet(key)
-	if mapEl == nil {
-		return nil, false
+func (m *TTLMap) liveElements(now int) []*mapElement {
+	live := make([]*mapElement, 0, len(m.elements))
+	for _, mapEl := range m.elements {
+		if mapEl.heapEl.Priority > now {
+			live = append(live, mapEl)
+		}
 	}
-	if expired {
+	return live
+}
+
+// Keys returns the keys of all live entries in unspecified order
+func (m *TTLMap) Keys() []string {
+	m.rLock()
+	defer m.rUnlock()
+
+	now := int(m.getClock().Now().Unix())
+	keys := make([]string, 0, len(m.elements))
+	for key, mapEl := range m.elements {
+		if mapEl.heapEl.Priority > now {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Values returns the values of all live entries in unspecified order,
+// expired entries are removed
+func (m *TTLMap) Values() []interface{} {
+	var values []interface{}
+	m.Range(func(_ string, value interface{}) bool {
+		values = append(values, value)
+		return true
+	})
+	return values
+}
+
+// Range calls f for every live entry until f returns false. Iteration
+// order is unspecified. Entries are collected before f is called, so f
+// may access and modify the map. Expired entries are skipped and removed.
+func (m *TTLMap) Range(f func(key string, value interface{}) bool) {
+	m.rLock()
+	now := int(m.getClock().Now().Unix())
+	var live []Entry
+	var expired []*mapElement
+	var errs []error
+	for _, mapEl := range m.elements {
+		if mapEl.heapEl.Priority <= now {
+			expired = append(expired, mapEl)
+			continue
+		}
+		value, err := m.decodeValue(mapEl)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		live = append(live, Entry{Key: mapEl.key, Value: value})
+	}
+	m.rUnlock()
+
+	m.notifyErrors(errs...)
+	for _, mapEl := range expired {
 		m.lockNDel(mapEl)
-		return nil, false
 	}
-	return value, true
+	for _, entry := range live {
+		if !f(entry.Key, m.copyValue(entry.Value)) {
+			return
+		}
+	}
 }
 
-func (m *TTLMap) Increment(key string, value int, ttlSeconds int) (int, error) {
-	expiryTime, err := m.toEpochSeconds(ttlSeconds)
-	if err != nil {
-		return 0, err
+// RangeByExpiry is like Range but calls f in ascending expiry order, with
+// the expiry time of the entry, which is zero if the entry never expires
+func (m *TTLMap) RangeByExpiry(f func(key string, value interface{}, expiresAt time.Time) bool) {
+	m.rLock()
+	now := int(m.getClock().Now().Unix())
+	type liveEntry struct {
+		mapEl *mapElement
+		value interface{}
+	}
+	var live []liveEntry
+	var expired []*mapElement
+	var errs []error
+	for _, mapEl := range m.elements {
+		if mapEl.heapEl.Priority <= now {
+			expired = append(expired, mapEl)
+			continue
+		}
+		value, err := m.decodeValue(mapEl)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		live = append(live, liveEntry{mapEl: mapEl, value: value})
+	}
+	sort.Slice(live, func(i, j int) bool {
+		a, b := live[i].mapEl, live[j].mapEl
+		if a.heapEl.Priority != b.heapEl.Priority {
+			return a.heapEl.Priority < b.heapEl.Priority
+		}
+		return m.breakTie(a.heapEl, b.heapEl)
+	})
+	expiresAt := make([]time.Time, len(live))
+	for i, entry := range live {
+		if entry.mapEl.heapEl.Priority != noExpiry {
+			expiresAt[i] = entry.mapEl.expiresAt()
+		}
+	}
+	m.rUnlock()
+
+	m.notifyErrors(errs...)
+	for _, mapEl := range expired {
+		m.lockNDel(mapEl)
+	}
+	for i, entry := range live {
+		if !f(entry.mapEl.key, m.copyValue(entry.value), expiresAt[i]) {
+			return
+		}
+	}
+}
+
+// CountIf returns the number of live entries whose value satisfies pred
+func (m *TTLMap) CountIf(pred func(value interface{}) bool) int {
+	var errs []error
+	m.rLock()
+	defer func() {
+		m.rUnlock()
+		m.notifyErrors(errs...)
+	}()
+
+	now := int(m.getClock().Now().Unix())
+	count := 0
+	for _, mapEl := range m.elements {
+		if mapEl.heapEl.Priority <= now {
+			continue
+		}
+		value, err := m.decodeValue(mapEl)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if pred(value) {
+			count += 1
+		}
 	}
+	return count
+}
 
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// CheckTTL reports whether the remaining TTL of the entry stored
+// under key lies within [min, max], it errors if the key is missing.
+// Entries that never expire have a remaining TTL of TTLOverflow.
+func (m *TTLMap) CheckTTL(key string, min, max time.Duration) (bool, error) {
+	m.rLock()
+	defer m.rUnlock()
 
 	mapEl, expired := m.get(key)
 	if mapEl == nil || expired {
-		m.set(key, value, expiryTime)
-		return value, nil
+		return false, fmt.Errorf("key %q not found", key)
 	}
+	ttl := mapEl.remaining(m.getClock().Now())
+	return ttl >= min && ttl <= max, nil
+}
 
-	currentValue, ok := mapEl.value.(int)
-	if !ok {
-		return 0, fmt.Errorf("Expected existing value to be integer, got %T", mapEl.value)
-	}
+// CountExpired returns the number of expired entries not removed yet,
+// without removing them or executing any callbacks
+func (m *TTLMap) CountExpired() int {
+	m.rLock()
+	defer m.rUnlock()
+	return m.expiryTimes.countUpTo(int(m.getClock().Now().Unix()))
+}
 
-	currentValue += value
-	m.set(key, currentValue, expiryTime)
-	return currentValue, nil
+// MostExpired returns the entry furthest past its expiry without
+// removing it, ok is false if no entry has expired
+func (m *TTLMap) MostExpired() (key string, overdue time.Duration, ok bool) {
+	m.rLock()
+	defer m.rUnlock()
+
+	if m.expiryTimes.Len() == 0 {
+		return "", 0, false
+	}
+	mapEl := m.expiryTimes.Peek().Value.(*mapElement)
+	overdue = -mapEl.remaining(m.getClock().Now())
+	if overdue < 0 {
+		return "", 0, false
+	}
+	return mapEl.key, overdue, true
 }
 
 func (m *TTLMap) GetInt(key string) (int, bool, error) {
@@ -115,21 +1544,87 @@ func (m *TTLMap) GetInt(key string) (int, bool, error) {
 	}
 	value, ok := valueI.(int)
 	if !ok {
-		return 0, false, fmt.Errorf("Expected existing value to be integer, got %T", valueI)
+		return 0, false, wrapf(ErrWrongType, "Expected existing value to be integer, got %T", valueI)
 	}
 	return value, true, nil
 }
 
-func (m *TTLMap) set(key string, value interface{}, expiryTime int) error {
-	if mapEl, ok := m.elements[key]; ok {
-		mapEl.value = value
-		m.expiryTimes.Update(mapEl.heapEl, expiryTime)
-		return nil
+// breakTie orders expiry queue items with the same expiry time
+func (m *TTLMap) breakTie(a, b *PQItem) bool {
+	elA, elB := a.Value.(*mapElement), b.Value.(*mapElement)
+	if m.tieBreaker == nil {
+		return elA.key < elB.key
+	}
+	return m.tieBreaker(tieEntry(elA), tieEntry(elB))
+}
+
+// tieEntry returns the entry passed to the tie-breaker, without
+// decompressing the value
+func tieEntry(mapEl *mapElement) Entry {
+	entry := Entry{Key: mapEl.key, TTLSeconds: mapEl.ttl}
+	if _, compressed := mapEl.value.(compressedValue); !compressed {
+		entry.Value = mapEl.value
+	}
+	return entry
+}
+
+// setIfAbsent stores the value only if there is no live entry
+// under key and reports whether it was stored
+func (m *TTLMap) setIfAbsent(key string, value interface{}, expiryTime int) (bool, error) {
+	if mapEl, expired := m.get(key); mapEl != nil && !expired {
+		return false, nil
+	}
+	if err := m.set(key, value, expiryTime); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// expiresAt returns the expiry time of the entry, callers must handle
+// entries that never expire first as their expiry time overflows
+func (mapEl *mapElement) expiresAt() time.Time {
+	return time.Unix(int64(mapEl.heapEl.Priority), 0)
+}
+
+// remaining returns the time left until the entry expires, entries
+// that never expire have TTLOverflow left
+func (mapEl *mapElement) remaining(now time.Time) time.Duration {
+	if mapEl.heapEl.Priority == noExpiry {
+		return TTLOverflow
 	}
+	return mapEl.expiresAt().Sub(now)
+}
 
-	if len(m.elements) >= m.capacity {
-		m.freeSpace(1)
+func (m *TTLMap) set(key string, value interface{}, expiryTime int) error {
+	return m.insert(key, value, expiryTime, m.costOf(value), true)
+}
+
+// insert stores the entry with the given cost, freeing space for it first
+// if makeRoom is true, otherwise the caller is responsible for calling
+// shrink after
+func (m *TTLMap) insert(key string, value interface{}, expiryTime int, cost int, makeRoom bool) error {
+	if m.maxCost > 0 && cost > m.maxCost {
+		return ErrValueTooLarge
+	}
+	// The overwritten entry is not reported as removed, it is put back
+	// if there is no room for the new one
+	overwritten := m.elements[key]
+	if overwritten != nil {
+		m.unlink(overwritten)
 	}
+	if makeRoom {
+		if err := m.makeRoom(cost); err != nil {
+			if overwritten != nil {
+				m.link(overwritten)
+			}
+			return err
+		}
+	}
+	if overwritten != nil && overwritten.closer != nil {
+		m.releaseCloser(overwritten.closer)
+	}
+
+	now := m.getClock().Now()
 	heapEl := &PQItem{
 		Priority: expiryTime,
 	}
@@ -137,23 +1632,139 @@ func (m *TTLMap) set(key string, value interface{}, expiryTime int) error {
 		key:    key,
 		value:  value,
 		heapEl: heapEl,
+		ttl:    ttlOf(expiryTime, int(now.Unix())),
+		cost:   cost,
+		pinned: overwritten != nil && overwritten.pinned,
+	}
+	if m.policy == PolicyLFU {
+		mapEl.lastAccess = atomic.AddInt64(&m.accessTick, 1)
 	}
 	heapEl.Value = mapEl
-	m.elements[key] = mapEl
-	m.expiryTimes.Push(heapEl)
+	m.link(mapEl)
+	m.inserts.add(now)
+	if makeRoom {
+		m.reportOverCapacity()
+	}
+	return nil
+}
+
+// shrink evicts entries until the map fits into its capacity and cost
+// limit, it returns ErrFull if only pinned entries are left to be evicted
+func (m *TTLMap) shrink() error {
+	if m.softCapacity {
+		m.reportOverCapacity()
+		return nil
+	}
+	if m.lowWatermark > 0 && len(m.elements) > m.capacity {
+		m.freeSpace(len(m.elements) - m.lowWatermark)
+	}
+	for len(m.elements) > m.capacity || (m.maxCost > 0 && m.totalCost > m.maxCost) {
+		if m.freeSpace(1) == 0 {
+			return ErrFull
+		}
+	}
+	return nil
+}
+
+// reportOverCapacity passes the number of entries above capacity, if any,
+// to the WithOnOverCapacity callback once the map lock is released
+func (m *TTLMap) reportOverCapacity() {
+	overflow := len(m.elements) - m.capacity
+	if onOverCapacity := m.onOverCapacity; overflow > 0 && onOverCapacity != nil {
+		m.deferUnlock(func() {
+			onOverCapacity(overflow)
+		})
+	}
+}
+
+// makeRoom frees space for a new entry of the given cost, it returns
+// ErrFull if only pinned entries are left to be evicted
+func (m *TTLMap) makeRoom(cost int) error {
+	if m.softCapacity {
+		if len(m.elements) >= m.capacity {
+			m.removeExpired(1)
+		}
+		return nil
+	}
+	if m.lowWatermark > 0 && len(m.elements) >= m.capacity {
+		m.freeSpace(len(m.elements) - m.lowWatermark + 1)
+	}
+	for len(m.elements) >= m.capacity || (m.maxCost > 0 && m.totalCost+cost > m.maxCost) {
+		if m.freeSpace(1) == 0 {
+			if len(m.elements) > 0 {
+				return ErrFull
+			}
+			return nil
+		}
+	}
 	return nil
 }
 
-func (m *TTLMap) lockNGet(key string) (value interface{}, mapEl *mapElement, expired bool) {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
+func (m *TTLMap) touch(mapEl *mapElement, expiryTime int) {
+	extended := expiryTime > mapEl.heapEl.Priority
+	mapEl.ttl = ttlOf(expiryTime, int(m.getClock().Now().Unix()))
+	m.expiryTimes.Update(mapEl.heapEl, expiryTime)
+	if !extended {
+		return
+	}
+	atomic.AddInt64(&m.stats.ttlExtensions, 1)
+	if onTTLExtended := m.onTTLExtended; onTTLExtended != nil {
+		key, newExpiry := mapEl.key, time.Time{}
+		if expiryTime != noExpiry {
+			newExpiry = mapEl.expiresAt()
+		}
+		m.deferUnlock(func() {
+			onTTLExtended(key, newExpiry)
+		})
+	}
+}
+
+func (m *TTLMap) lockNGet(key string) (value interface{}, mapEl *mapElement, expired bool, err error) {
+	m.rLock()
+	defer m.rUnlock()
 
 	mapEl, expired = m.get(key)
 	value = nil
 	if mapEl != nil {
-		value = mapEl.value
+		value, err = m.decodeValue(mapEl)
+		if !expired && m.earlyBeta > 0 {
+			expired = m.expiresEarly(mapEl)
+		}
+	}
+	return value, mapEl, expired, err
+}
+
+// expiresEarly decides whether the entry should be treated as expired
+// ahead of its expiry time, see WithProbabilisticEarlyExpiry
+func (m *TTLMap) expiresEarly(mapEl *mapElement) bool {
+	if mapEl.heapEl.Priority == noExpiry {
+		return false
 	}
-	return value, mapEl, expired
+	remaining := mapEl.expiresAt().Sub(m.getClock().Now()).Seconds()
+	delta := m.earlyBeta * float64(mapEl.ttl)
+	return -delta*math.Log(1-m.randFloat64()) >= remaining
+}
+
+func (m *TTLMap) copyValue(value interface{}) interface{} {
+	if m.copier == nil {
+		return value
+	}
+	return m.copier(value)
+}
+
+func (m *TTLMap) randFloat64() float64 {
+	m.randMutex.Lock()
+	defer m.randMutex.Unlock()
+	return m.getRand().Float64()
+}
+
+// getRand returns the source of randomness, creating it on first use,
+// it must be called with randMutex held
+func (m *TTLMap) getRand() *rand.Rand {
+	if m.rand == nil {
+		m.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return m.rand
 }
 
 func (m *TTLMap) get(key string) (*mapElement, bool) {
@@ -161,14 +1772,14 @@ func (m *TTLMap) get(key string) (*mapElement, bool) {
 	if !ok {
 		return nil, false
 	}
-	now := int(m.clock.Now().Unix())
+	now := int(m.getClock().Now().Unix())
 	expired := mapEl.heapEl.Priority <= now
 	return mapEl, expired
 }
 
 func (m *TTLMap) lockNDel(mapEl *mapElement) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	m.lock()
+	defer m.unlock()
 
 	// Map element could have been updated. Now that we have a lock
 	// retrieve it again and check if it is still expired.
@@ -176,60 +1787,351 @@ func (m *TTLMap) lockNDel(mapEl *mapElement) {
 	if mapEl, ok = m.elements[mapEl.key]; !ok {
 		return
 	}
-	now := int(m.clock.Now().Unix())
-	if mapEl.heapEl.Priority > now {
+	now := int(m.getClock().Now().Unix())
+	if mapEl.heapEl.Priority > now || !m.allowExpiration(now) {
 		return
 	}
 
-	if m.OnExpire != nil {
-		m.OnExpire(mapEl.key, mapEl.value)
+	m.removeElement(mapEl, ReasonExpired)
+}
+
+func (m *TTLMap) removeElement(mapEl *mapElement, reason Reason) {
+	var onExpire func(key string, value interface{})
+	if reason == ReasonExpired {
+		onExpire = m.OnExpire
+	}
+	sinking := reason == ReasonExpired && m.expireSink != nil
+	var value interface{}
+	if onExpire != nil || m.onEvict != nil || m.expireEvents != nil || sinking {
+		// values failing to decode are reported and passed on as nil
+		value, _ = m.valueOf(mapEl)
+	}
+	if onExpire != nil || m.onEvict != nil {
+		m.removed = append(m.removed, removal{
+			onExpire: onExpire,
+			onEvict:  m.onEvict,
+			key:      mapEl.key,
+			value:    value,
+			reason:   reason,
+		})
+	}
+	if m.expireEvents != nil {
+		m.sendExpireEvent(ExpireEvent{Key: mapEl.key, Value: value, Reason: reason})
+	}
+	if sinking {
+		m.sinkExpired(Entry{Key: mapEl.key, Value: value, TTLSeconds: mapEl.ttl})
+	}
+	m.stats.countRemoval(reason)
+	m.removals[reason].add(m.getClock().Now())
+	m.detach(mapEl)
+}
+
+// removal is a removed entry awaiting its callbacks
+type removal struct {
+	onExpire func(key string, value interface{})
+	onEvict  func(key string, value interface{}, reason Reason)
+	key      string
+	value    interface{}
+	reason   Reason
+}
+
+// unlock releases the map lock acquired for writing and then executes the
+// callbacks of entries removed and the calls deferred while holding it,
+// so that callbacks may access the map
+func (m *TTLMap) unlock() {
+	removed, deferred := m.removed, m.deferred
+	m.removed, m.deferred = nil, nil
+	m.mutex.Unlock()
+
+	for _, r := range removed {
+		if r.onExpire != nil {
+			r.onExpire(r.key, r.value)
+		}
+		if r.onEvict != nil {
+			r.onEvict(r.key, r.value, r.reason)
+		}
+	}
+	for _, f := range deferred {
+		f()
+	}
+}
+
+// deferUnlock schedules f to be called by unlock once the map lock is
+// released, so that user functions called by f may access the map
+func (m *TTLMap) deferUnlock(f func()) {
+	m.deferred = append(m.deferred, f)
+}
+
+// reportError passes err to the WithOnError function once the map lock is
+// released
+func (m *TTLMap) reportError(err error) {
+	if onError := m.onError; onError != nil {
+		m.deferUnlock(func() {
+			onError(err)
+		})
 	}
+}
+
+// detach removes the entry from the map and its indexes without reporting
+// the removal and releases its closer
+func (m *TTLMap) detach(mapEl *mapElement) {
+	m.unlink(mapEl)
+	if mapEl.closer != nil {
+		m.releaseCloser(mapEl.closer)
+	}
+}
 
+// unlink removes the entry from the map and the indexes keeping its tags,
+// so that it can be put back with link
+func (m *TTLMap) unlink(mapEl *mapElement) {
+	m.untag(mapEl)
+	m.unindex(mapEl)
+	if mapEl.pinned {
+		m.pinnedCount -= 1
+	}
 	delete(m.elements, mapEl.key)
 	m.expiryTimes.Remove(mapEl.heapEl)
+	m.totalCost -= mapEl.cost
+}
+
+// link adds the entry to the map and the indexes
+func (m *TTLMap) link(mapEl *mapElement) {
+	tags := mapEl.tags
+	mapEl.tags = nil
+	m.elements[mapEl.key] = mapEl
+	m.expiryTimes.Push(mapEl.heapEl)
+	m.index(mapEl)
+	m.tag(mapEl, tags)
+	if mapEl.pinned {
+		m.pinnedCount += 1
+	}
+	m.totalCost += mapEl.cost
 }
 
-func (m *TTLMap) freeSpace(count int) {
-	removed := m.RemoveExpired(count)
+func (m *TTLMap) freeSpace(count int) int {
+	if m.asyncSweeps {
+		m.signalSweep()
+		return m.removeLastUsed(count)
+	}
+	removed := m.removeExpired(count)
 	if removed >= count {
-		return
+		return removed
+	}
+	return removed + m.removeLastUsed(count-removed)
+}
+
+// EvictFraction removes the given fraction of live entries, those closest
+// to their expiry or the least frequently used ones with PolicyLFU, and
+// returns the number of live entries removed. Expired entries are removed
+// first and not counted.
+func (m *TTLMap) EvictFraction(fraction float64) int {
+	if fraction <= 0 {
+		return 0
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	m.lock()
+	defer m.unlock()
+
+	now := int(m.getClock().Now().Unix())
+	m.removeExpired(len(m.elements))
+	live := len(m.elements) - m.expiryTimes.countUpTo(now)
+	evicted := 0
+	for target := int(fraction * float64(live)); evicted < target; {
+		mapEl := m.evictionVictim(now)
+		if mapEl == nil {
+			break
+		}
+		if mapEl.heapEl.Priority <= now {
+			// left over by WithExpireRateLimit
+			m.removeElement(mapEl, ReasonExpired)
+			continue
+		}
+		m.removeElement(mapEl, ReasonCapacity)
+		evicted += 1
 	}
-	m.RemoveLastUsed(count - removed)
+	return evicted
 }
 
+// RemoveExpired removes up to iterations expired entries and
+// returns the number of entries removed
 func (m *TTLMap) RemoveExpired(iterations int) int {
+	m.lock()
+	defer m.unlock()
+	return m.removeExpired(iterations)
+}
+
+// RemoveLastUsed removes up to iterations entries closest to their expiry,
+// or the least frequently used entries with PolicyLFU
+func (m *TTLMap) RemoveLastUsed(iterations int) {
+	m.lock()
+	defer m.unlock()
+	m.removeLastUsed(iterations)
+}
+
+// ExpiredEntry is an entry removed by PopExpired
+type ExpiredEntry struct {
+	Key       string
+	Value     interface{}
+	ExpiredAt time.Time
+}
+
+// PopExpired removes all expired entries and returns them in expiry order
+// for the caller to process. OnExpire and the other callbacks are not
+// executed for them and they are not passed to the expire sink, but they
+// are counted as expirations in Stats.
+func (m *TTLMap) PopExpired() []ExpiredEntry {
+	m.lock()
+	defer m.unlock()
+
+	var popped []ExpiredEntry
+	now := m.getClock().Now()
+	for m.expiryTimes.Len() > 0 && m.expiryTimes.Peek().Priority <= int(now.Unix()) {
+		mapEl := m.expiryTimes.Peek().Value.(*mapElement)
+		value, _ := m.valueOf(mapEl)
+		popped = append(popped, ExpiredEntry{
+			Key:       mapEl.key,
+			Value:     value,
+			ExpiredAt: mapEl.expiresAt(),
+		})
+		m.stats.countRemoval(ReasonExpired)
+		m.removals[ReasonExpired].add(now)
+		m.detach(mapEl)
+	}
+	return popped
+}
+
+func (m *TTLMap) removeExpired(iterations int) int {
 	removed := 0
-	now := int(m.clock.Now().Unix())
+	now := int(m.getClock().Now().Unix())
 	for i := 0; i < iterations; i += 1 {
 		if len(m.elements) == 0 {
 			break
 		}
 		heapEl := m.expiryTimes.Peek()
-		if heapEl.Priority > now {
+		if heapEl.Priority > now || !m.allowExpiration(now) {
 			break
 		}
-		m.expiryTimes.Pop()
-		mapEl := heapEl.Value.(*mapElement)
-		delete(m.elements, mapEl.key)
+		m.removeElement(heapEl.Value.(*mapElement), ReasonExpired)
 		removed += 1
 	}
 	return removed
 }
 
-func (m *TTLMap) RemoveLastUsed(iterations int) {
+// allowExpiration reports whether another expired entry may be removed
+// within the current second, see WithExpireRateLimit
+func (m *TTLMap) allowExpiration(now int) bool {
+	if m.expireRateLimit <= 0 {
+		return true
+	}
+	if m.expireWindow != now {
+		m.expireWindow = now
+		m.expireCount = 0
+	}
+	if m.expireCount >= m.expireRateLimit {
+		return false
+	}
+	m.expireCount += 1
+	return true
+}
+
+func (m *TTLMap) removeLastUsed(iterations int) int {
+	removed := 0
+	now := int(m.getClock().Now().Unix())
 	for i := 0; i < iterations; i += 1 {
-		if len(m.elements) == 0 {
-			return
+		mapEl := m.evictionVictim(now)
+		if mapEl == nil {
+			break
 		}
-		heapEl := m.expiryTimes.Pop()
-		mapEl := heapEl.Value.(*mapElement)
-		delete(m.elements, mapEl.key)
+		reason := ReasonCapacity
+		if mapEl.heapEl.Priority <= now {
+			reason = ReasonExpired
+		}
+		m.removeElement(mapEl, reason)
+		removed += 1
+	}
+	return removed
+}
+
+// costOf returns the cost of the value as it is stored
+func (m *TTLMap) costOf(value interface{}) int {
+	if m.coster == nil {
+		return 0
+	}
+	if compressed, ok := value.(compressedValue); ok {
+		return len(compressed.data)
+	}
+	return m.coster(value)
+}
+
+// prepareValue validates the value and converts it to the form
+// it is stored in
+func (m *TTLMap) prepareValue(value interface{}) (interface{}, error) {
+	if err := m.checkValueSize(value); err != nil {
+		return nil, err
+	}
+	return m.encodeValue(value)
+}
+
+func (m *TTLMap) checkValueSize(value interface{}) error {
+	if m.sizer != nil && m.sizer(value) > m.maxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+func defaultSizer(value interface{}) int {
+	switch v := value.(type) {
+	case []byte:
+		return len(v)
+	case string:
+		return len(v)
+	}
+	return 0
+}
+
+// defaultEqual compares values with == if their types are comparable and
+// with reflect.DeepEqual otherwise, or if == panics because the values
+// hold uncomparable values in interface fields
+func defaultEqual(a, b interface{}) (equal bool) {
+	if a == nil || b == nil {
+		return a == b
 	}
+	if !reflect.TypeOf(a).Comparable() || !reflect.TypeOf(b).Comparable() {
+		return reflect.DeepEqual(a, b)
+	}
+	defer func() {
+		if recover() != nil {
+			equal = reflect.DeepEqual(a, b)
+		}
+	}()
+	return a == b
 }
 
 func (m *TTLMap) toEpochSeconds(ttlSeconds int) (int, error) {
+	if ttlSeconds == 0 && m.allowNoExpiry {
+		return noExpiry, nil
+	}
 	if ttlSeconds <= 0 {
-		return 0, fmt.Errorf("ttlSeconds should be >= 0, got %d", ttlSeconds)
+		return 0, wrapf(ErrInvalidTTL, "ttlSeconds should be >= 0, got %d", ttlSeconds)
+	}
+	if m.ttlJitter > 0 {
+		jittered := math.Round(float64(ttlSeconds) * (1 + m.ttlJitter*(2*m.randFloat64()-1)))
+		ttlSeconds = int(math.Max(jittered, 1))
+	}
+	expiryTime := int(m.getClock().Now().Add(time.Second * time.Duration(ttlSeconds)).Unix())
+	if m.ttlBucket > 1 {
+		expiryTime = (expiryTime + m.ttlBucket - 1) / m.ttlBucket * m.ttlBucket
+	}
+	return expiryTime, nil
+}
+
+// ttlOf returns the TTL in seconds of an entry expiring at expiryTime,
+// entries that never expire have TTL of 0
+func ttlOf(expiryTime, now int) int {
+	if expiryTime == noExpiry {
+		return 0
 	}
-	return int(m.clock.Now().Add(time.Second * time.Duration(ttlSeconds)).Unix()), nil
+	return expiryTime - now
 }
@@ -16,6 +16,13 @@ limitations under the License.
 package ttlmap
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -338,8 +345,1787 @@ func (s *TTLMapSuite) TestCallOnExpire() {
 	s.Require().Equal(1, val)
 }
 
-func newTTLMap(ttlSeconds int, clock clockwork.FakeClock) *TTLMap {
-	m := NewTTLMap(ttlSeconds)
-	m.clock = clock
-	return m
+func (s *TTLMapSuite) TestSetOnExpireConcurrent() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+
+	var calls int64
+	handler := func(string, interface{}) {
+		atomic.AddInt64(&calls, 1)
+	}
+	m.SetOnExpire(handler)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			m.SetOnExpire(handler)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			m.Set("a", i, 1)
+			clock.Advance(time.Second)
+			m.Get("a")
+		}
+	}()
+	wg.Wait()
+
+	s.Require().Equal(int64(100), atomic.LoadInt64(&calls))
+}
+
+func (s *TTLMapSuite) TestTTLBuckets() {
+	clock := clockwork.NewFakeClockAt(time.Unix(1000, 0))
+	m := newTTLMap(10, clock, WithTTLBuckets(6, 60))
+
+	for key, ttl := range map[string]int{"a": 1, "b": 3, "c": 10, "d": 11} {
+		err := m.Set(key, ttl, ttl)
+		s.Require().Equal(nil, err)
+	}
+	s.Require().Equal(1010, m.elements["a"].heapEl.Priority)
+	s.Require().Equal(1010, m.elements["b"].heapEl.Priority)
+	s.Require().Equal(1010, m.elements["c"].heapEl.Priority)
+	s.Require().Equal(1020, m.elements["d"].heapEl.Priority)
+
+	clock.Advance(9 * time.Second)
+	s.Require().Equal(0, m.RemoveExpired(10))
+
+	clock.Advance(1 * time.Second)
+	s.Require().Equal(3, m.RemoveExpired(10))
+	s.Require().Equal(1, m.Len())
+}
+
+func (s *TTLMapSuite) TestEvictFraction() {
+	evicted := make(map[string]Reason)
+	m := NewTTLMap(10, WithOnEvict(func(key string, _ interface{}, reason Reason) {
+		evicted[key] = reason
+	}))
+
+	for i := 1; i <= 10; i++ {
+		err := m.Set(fmt.Sprint(i), i, i)
+		s.Require().Equal(nil, err)
+	}
+
+	s.Require().Equal(5, m.EvictFraction(0.5))
+	s.Require().Equal(5, m.Len())
+	for i := 1; i <= 10; i++ {
+		_, exists := m.Get(fmt.Sprint(i))
+		s.Require().Equal(i > 5, exists)
+	}
+	s.Require().Equal(map[string]Reason{
+		"1": ReasonCapacity,
+		"2": ReasonCapacity,
+		"3": ReasonCapacity,
+		"4": ReasonCapacity,
+		"5": ReasonCapacity,
+	}, evicted)
+
+	s.Require().Equal(0, m.EvictFraction(0))
+	s.Require().Equal(5, m.EvictFraction(2))
+	s.Require().Equal(0, m.Len())
+}
+
+func (s *TTLMapSuite) TestEvictFractionSkipsExpired() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(6, clock)
+	for i := 0; i < 4; i++ {
+		s.Require().Equal(nil, m.Set(fmt.Sprint("old", i), i, 1))
+	}
+	s.Require().Equal(nil, m.Set("a", 1, 10))
+	s.Require().Equal(nil, m.Set("b", 2, 20))
+	clock.Advance(time.Second)
+
+	s.Require().Equal(1, m.EvictFraction(0.5))
+	s.Require().Equal(1, m.RawLen())
+	_, exists := m.Get("b")
+	s.Require().Equal(true, exists)
+}
+
+func (s *TTLMapSuite) TestCompareAndSwap() {
+	m := NewTTLMap(1)
+
+	swapped, err := m.CompareAndSwap("a", 1, 2, 1)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(false, swapped)
+
+	err = m.Set("a", 1, 1)
+	s.Require().Equal(nil, err)
+
+	swapped, err = m.CompareAndSwap("a", 3, 2, 1)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(false, swapped)
+
+	swapped, err = m.CompareAndSwap("a", 1, 2, 1)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, swapped)
+
+	valI, _ := m.Get("a")
+	s.Require().Equal(2, valI)
+
+	err = m.Set("b", []int{1}, 1)
+	s.Require().Equal(nil, err)
+	swapped, err = m.CompareAndSwap("b", []int{1}, []int{2}, 1)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, swapped)
+
+	// comparable type holding an uncomparable value
+	err = m.Set("c", casHolder{X: []int{1}}, 1)
+	s.Require().Equal(nil, err)
+	swapped, err = m.CompareAndSwap("c", casHolder{X: []int{2}}, casHolder{X: 3}, 1)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(false, swapped)
+	swapped, err = m.CompareAndSwap("c", casHolder{X: []int{1}}, casHolder{X: 3}, 1)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, swapped)
+}
+
+type casHolder struct {
+	X interface{}
+}
+
+type casValue struct {
+	ID    int
+	Items []string
+}
+
+func (s *TTLMapSuite) TestCompareAndSwapEqualFunc() {
+	m := NewTTLMap(1, WithEqualFunc(func(a, b interface{}) bool {
+		return a.(casValue).ID == b.(casValue).ID
+	}))
+
+	err := m.Set("a", casValue{ID: 1, Items: []string{"x"}}, 1)
+	s.Require().Equal(nil, err)
+
+	swapped, err := m.CompareAndSwap("a", casValue{ID: 1}, casValue{ID: 2}, 1)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, swapped)
+
+	swapped, err = m.CompareAndSwap("a", casValue{ID: 1}, casValue{ID: 3}, 1)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(false, swapped)
+
+	valI, _ := m.Get("a")
+	s.Require().Equal(casValue{ID: 2}, valI)
+}
+
+func (s *TTLMapSuite) TestServeStaleUntilWrite() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock, WithServeStaleUntilWrite())
+
+	err := m.Set("a", 1, 1)
+	s.Require().Equal(nil, err)
+
+	valI, fresh, exists := m.GetFresh("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(true, fresh)
+	s.Require().Equal(1, valI)
+
+	clock.Advance(1 * time.Second)
+
+	valI, fresh, exists = m.GetFresh("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(false, fresh)
+	s.Require().Equal(1, valI)
+
+	valI, exists = m.Get("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(1, valI)
+
+	err = m.Set("a", 2, 1)
+	s.Require().Equal(nil, err)
+
+	valI, fresh, exists = m.GetFresh("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(true, fresh)
+	s.Require().Equal(2, valI)
+
+	clock.Advance(1 * time.Second)
+
+	val, err := m.Increment("a", 1, 1)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(1, val)
+
+	clock.Advance(1 * time.Second)
+	s.Require().Equal(1, m.RemoveExpired(10))
+
+	_, fresh, exists = m.GetFresh("a")
+	s.Require().Equal(false, exists)
+	s.Require().Equal(false, fresh)
+}
+
+func (s *TTLMapSuite) TestGetFresh() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1, clock)
+
+	err := m.Set("a", 1, 1)
+	s.Require().Equal(nil, err)
+
+	clock.Advance(1 * time.Second)
+
+	_, fresh, exists := m.GetFresh("a")
+	s.Require().Equal(false, exists)
+	s.Require().Equal(false, fresh)
+	s.Require().Equal(0, m.Len())
+}
+
+func (s *TTLMapSuite) TestEntriesWithTTL() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(3, clock)
+
+	m.Set("a", 1, 1)
+	m.Set("b", 2, 5)
+	m.Set("c", 3, 10)
+
+	clock.Advance(2 * time.Second)
+
+	entries := m.EntriesWithTTL()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	s.Require().Equal([]EntryWithTTL{
+		{Key: "b", Value: 2, TTL: 3 * time.Second},
+		{Key: "c", Value: 3, TTL: 8 * time.Second},
+	}, entries)
+
+	m = newTTLMap(1, clock, WithNoExpiry())
+	m.Set("a", 1, 0)
+	s.Require().Equal([]EntryWithTTL{{Key: "a", Value: 1, TTL: 0}}, m.EntriesWithTTL())
+}
+
+func (s *TTLMapSuite) TestSetExpiry() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1, clock)
+
+	err := m.SetExpiry("a", 1, clock.Now().Add(-time.Second))
+	s.Require().True(errors.Is(err, ErrInvalidTTL))
+
+	s.Require().Equal(nil, m.SetExpiry("a", 1, clock.Now().Add(3*time.Second)))
+	clock.Advance(2 * time.Second)
+	_, exists := m.Get("a")
+	s.Require().Equal(true, exists)
+	clock.Advance(time.Second)
+	_, exists = m.Get("a")
+	s.Require().Equal(false, exists)
+}
+
+func (s *TTLMapSuite) TestSetExpireAt() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1, clock)
+
+	err := m.SetExpireAt("a", 1, clock.Now())
+	s.Require().EqualError(err, fmt.Sprintf("expireAt should be in the future, got %v", clock.Now()))
+
+	err = m.SetExpireAt("a", 1, clock.Now().Add(90*time.Second))
+	s.Require().Equal(nil, err)
+
+	clock.Advance(89 * time.Second)
+	_, exists := m.Get("a")
+	s.Require().Equal(true, exists)
+
+	clock.Advance(1 * time.Second)
+	_, exists = m.Get("a")
+	s.Require().Equal(false, exists)
+}
+
+func (s *TTLMapSuite) TestContainsAll() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock)
+
+	m.Set("a", 1, 1)
+	m.Set("b", 2, 10)
+
+	clock.Advance(1 * time.Second)
+
+	s.Require().Equal(map[string]bool{
+		"a": false,
+		"b": true,
+		"c": false,
+	}, m.ContainsAll([]string{"a", "b", "c"}))
+	s.Require().Equal(2, m.RawLen())
+}
+
+func (s *TTLMapSuite) TestIncrementCapped() {
+	m := NewTTLMap(1)
+
+	val, err := m.IncrementCapped("a", 60, 10, 100)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(60, val)
+
+	val, err = m.IncrementCapped("a", 60, 10, 100)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(100, val)
+
+	val, exists, err := m.GetInt("a")
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, exists)
+	s.Require().Equal(100, val)
+
+	val, err = m.IncrementCapped("a", -30, 10, 100)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(70, val)
+
+	_, err = m.IncrementCapped("a", 1, 0, 100)
+	s.Require().EqualError(err, "ttlSeconds should be >= 0, got 0")
+}
+
+func (s *TTLMapSuite) TestProbabilisticEarlyExpiry() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1, clock, WithProbabilisticEarlyExpiry(0.1), WithRandSource(rand.NewSource(1)))
+
+	err := m.Set("a", 1, 100)
+	s.Require().Equal(nil, err)
+
+	var misses []int
+	for _, elapsed := range []int{50, 30, 10, 9} {
+		clock.Advance(time.Duration(elapsed) * time.Second)
+		count := 0
+		for i := 0; i < 1000; i++ {
+			if _, exists := m.Get("a"); !exists {
+				count += 1
+			}
+		}
+		misses = append(misses, count)
+	}
+
+	s.Require().True(misses[0] < 50, "%v", misses)
+	for i := 1; i < len(misses); i++ {
+		s.Require().True(misses[i] > misses[i-1], "%v", misses)
+	}
+	s.Require().True(misses[3] > 800, "%v", misses)
+	s.Require().Equal(1, m.Len())
+}
+
+func (s *TTLMapSuite) TestMostExpired() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(4, clock)
+
+	_, _, ok := m.MostExpired()
+	s.Require().Equal(false, ok)
+
+	m.Set("a", 1, 3)
+	m.Set("b", 2, 1)
+	m.Set("c", 3, 2)
+	m.Set("d", 4, 10)
+
+	_, _, ok = m.MostExpired()
+	s.Require().Equal(false, ok)
+
+	clock.Advance(5 * time.Second)
+
+	key, overdue, ok := m.MostExpired()
+	s.Require().Equal(true, ok)
+	s.Require().Equal("b", key)
+	s.Require().Equal(4*time.Second, overdue)
+	s.Require().Equal(4, m.RawLen())
+
+	m = newTTLMap(1, clock, WithNoExpiry())
+	m.Set("a", 1, 0)
+	_, _, ok = m.MostExpired()
+	s.Require().Equal(false, ok)
+}
+
+func (s *TTLMapSuite) TestCountExpired() {
+	clock := clockwork.NewFakeClock()
+	var expired []string
+	m := newTTLMap(5, clock)
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired = append(expired, key)
+	})
+	s.Require().Equal(0, m.CountExpired())
+
+	m.Set("a", 1, 1)
+	m.Set("b", 2, 2)
+	m.Set("c", 3, 3)
+	m.Set("d", 4, 4)
+	m.Set("e", 5, 5)
+
+	clock.Advance(3 * time.Second)
+	s.Require().Equal(3, m.CountExpired())
+	s.Require().Equal(5, m.RawLen())
+	s.Require().Empty(expired)
+
+	s.Require().Equal(3, m.RemoveExpired(5))
+	s.Require().Equal(0, m.CountExpired())
+}
+
+func (s *TTLMapSuite) TestGetAndTouch() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1, clock)
+
+	_, exists, err := m.GetAndTouch("a", 5)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(false, exists)
+
+	err = m.Set("a", 1, 2)
+	s.Require().Equal(nil, err)
+
+	clock.Advance(1 * time.Second)
+
+	valI, exists, err := m.GetAndTouch("a", 5)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, exists)
+	s.Require().Equal(1, valI)
+
+	clock.Advance(4 * time.Second)
+
+	valI, exists = m.Get("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(1, valI)
+
+	clock.Advance(1 * time.Second)
+
+	_, exists, err = m.GetAndTouch("a", 5)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(false, exists)
+
+	_, _, err = m.GetAndTouch("a", 0)
+	s.Require().EqualError(err, "ttlSeconds should be >= 0, got 0")
+}
+
+func (s *TTLMapSuite) TestMaxValueSize() {
+	m := NewTTLMap(2, WithMaxValueSize(4, nil))
+
+	err := m.Set("a", []byte("banana"), 1)
+	s.Require().Equal(ErrValueTooLarge, err)
+	_, exists := m.Get("a")
+	s.Require().Equal(false, exists)
+
+	err = m.Set("a", []byte("kiwi"), 1)
+	s.Require().Equal(nil, err)
+	valI, exists := m.Get("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal([]byte("kiwi"), valI)
+
+	_, err = m.Increment("b", 100, 1)
+	s.Require().Equal(nil, err)
+}
+
+func (s *TTLMapSuite) TestMaxValueSizeSizer() {
+	m := NewTTLMap(1, WithMaxValueSize(10, func(value interface{}) int {
+		return value.(int)
+	}))
+
+	_, err := m.Increment("a", 10, 1)
+	s.Require().Equal(nil, err)
+
+	_, err = m.Increment("a", 1, 1)
+	s.Require().Equal(ErrValueTooLarge, err)
+
+	val, _, err := m.GetInt("a")
+	s.Require().Equal(nil, err)
+	s.Require().Equal(10, val)
+}
+
+func (s *TTLMapSuite) TestSoftCapacity() {
+	clock := clockwork.NewFakeClock()
+	var overflows []int
+	var m *TTLMap
+	m = newTTLMap(2, clock, WithSoftCapacity(), WithOnOverCapacity(func(overflow int) {
+		// the callback can access the map
+		s.Require().Equal(overflow, m.OverCapacity())
+		overflows = append(overflows, overflow)
+	}))
+
+	for i := 0; i < 4; i++ {
+		err := m.Set(fmt.Sprint(i), i, i+1)
+		s.Require().Equal(nil, err)
+	}
+	s.Require().Equal(4, m.Len())
+	s.Require().Equal(2, m.OverCapacity())
+	s.Require().Equal([]int{1, 2}, overflows)
+
+	clock.Advance(1 * time.Second)
+
+	err := m.Set("4", 4, 10)
+	s.Require().Equal(nil, err)
+	_, exists := m.Get("0")
+	s.Require().Equal(false, exists)
+	s.Require().Equal(4, m.Len())
+	s.Require().Equal(2, m.OverCapacity())
+}
+
+func (s *TTLMapSuite) TestSetClock() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock)
+
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 20)
+	clock.Advance(5 * time.Second)
+
+	newClock := clockwork.NewFakeClockAt(clock.Now().Add(time.Hour))
+	m.SetClock(newClock, true)
+
+	entries := m.EntriesWithTTL()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	s.Require().Equal([]EntryWithTTL{
+		{Key: "a", Value: 1, TTL: 5 * time.Second},
+		{Key: "b", Value: 2, TTL: 15 * time.Second},
+	}, entries)
+
+	newClock.Advance(5 * time.Second)
+	_, exists := m.Get("a")
+	s.Require().Equal(false, exists)
+	_, exists = m.Get("b")
+	s.Require().Equal(true, exists)
+
+	m.SetClock(clock, false)
+	_, exists = m.Get("b")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(1, len(m.EntriesWithTTL()))
+	s.Require().Equal((time.Hour + 15*time.Second), m.EntriesWithTTL()[0].TTL)
+}
+
+func (s *TTLMapSuite) TestCopyOnGet() {
+	m := NewTTLMap(1, WithCopyOnGet(func(value interface{}) interface{} {
+		return append([]string(nil), value.([]string)...)
+	}))
+
+	err := m.Set("a", []string{"x", "y"}, 10)
+	s.Require().Equal(nil, err)
+
+	valI, exists := m.Get("a")
+	s.Require().Equal(true, exists)
+	valI.([]string)[0] = "z"
+
+	valI, exists = m.Get("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal([]string{"x", "y"}, valI)
+}
+
+func (s *TTLMapSuite) TestLoadFrom() {
+	m := NewTTLMap(3)
+
+	ch := make(chan Entry)
+	go func() {
+		for i := 1; i <= 5; i++ {
+			ch <- Entry{Key: fmt.Sprint(i), Value: i, TTLSeconds: i}
+		}
+		ch <- Entry{Key: "invalid", Value: 0, TTLSeconds: 0}
+		close(ch)
+	}()
+
+	s.Require().Equal(5, m.LoadFrom(ch))
+	s.Require().Equal(3, m.Len())
+	for i := 1; i <= 5; i++ {
+		_, exists := m.Get(fmt.Sprint(i))
+		s.Require().Equal(i > 2, exists)
+	}
+}
+
+func (s *TTLMapSuite) TestCheckTTL() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1, clock)
+
+	_, err := m.CheckTTL("a", 0, time.Second)
+	s.Require().EqualError(err, `key "a" not found`)
+
+	m.Set("a", 1, 10)
+	clock.Advance(3 * time.Second)
+
+	ok, err := m.CheckTTL("a", 6*time.Second, 8*time.Second)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, ok)
+
+	ok, err = m.CheckTTL("a", 8*time.Second, 10*time.Second)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(false, ok)
+
+	m = newTTLMap(1, clock, WithNoExpiry())
+	m.Set("a", 1, 0)
+	ok, err = m.CheckTTL("a", 0, time.Hour)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(false, ok)
+	ok, err = m.CheckTTL("a", time.Hour, TTLOverflow)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, ok)
+}
+
+func (s *TTLMapSuite) TestExpireRateLimit() {
+	clock := clockwork.NewFakeClock()
+	var expired []string
+	m := newTTLMap(10, clock, WithExpireRateLimit(3))
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired = append(expired, key)
+	})
+
+	for i := 0; i < 7; i++ {
+		err := m.Set(fmt.Sprint(i), i, 1)
+		s.Require().Equal(nil, err)
+	}
+	clock.Advance(1 * time.Second)
+
+	s.Require().Equal(3, m.RemoveExpired(10))
+	s.Require().Equal(0, m.RemoveExpired(10))
+	s.Require().Equal(3, len(expired))
+
+	_, exists := m.Get("6")
+	s.Require().Equal(false, exists)
+	s.Require().Equal(3, len(expired))
+	s.Require().Equal(4, m.RawLen())
+
+	clock.Advance(1 * time.Second)
+	s.Require().Equal(3, m.RemoveExpired(10))
+	s.Require().Equal(6, len(expired))
+
+	clock.Advance(1 * time.Second)
+	s.Require().Equal(1, m.RemoveExpired(10))
+	s.Require().Equal(7, len(expired))
+	s.Require().Equal(0, m.Len())
+}
+
+func (s *TTLMapSuite) TestMaxEntriesAndCost() {
+	m := NewTTLMap(0, WithMaxEntries(2), WithMaxCost(10, nil))
+
+	// count limit
+	s.Require().Equal(nil, m.Set("a", "1", 1))
+	s.Require().Equal(nil, m.Set("b", "2", 2))
+	s.Require().Equal(nil, m.Set("c", "3", 3))
+	s.Require().Equal(map[string]bool{"a": false, "b": true, "c": true},
+		m.ContainsAll([]string{"a", "b", "c"}))
+
+	m = NewTTLMap(0, WithMaxEntries(3), WithMaxCost(10, nil))
+
+	// cost limit
+	s.Require().Equal(nil, m.Set("a", "aaaa", 1))
+	s.Require().Equal(nil, m.Set("b", "bbbb", 2))
+	s.Require().Equal(nil, m.Set("c", "cccc", 3))
+	s.Require().Equal(map[string]bool{"a": false, "b": true, "c": true},
+		m.ContainsAll([]string{"a", "b", "c"}))
+	s.Require().Equal(8, m.totalCost)
+
+	// overwrite replaces the cost of the previous value
+	s.Require().Equal(nil, m.Set("b", "bb", 2))
+	s.Require().Equal(6, m.totalCost)
+
+	s.Require().Equal(ErrValueTooLarge, m.Set("d", "ddddddddddd", 1))
+	s.Require().Equal(2, m.Len())
+}
+
+func (s *TTLMapSuite) TestCountIf() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(5, clock)
+
+	m.Set("a", 200, 10)
+	m.Set("b", 500, 10)
+	m.Set("c", 404, 10)
+	m.Set("d", 200, 10)
+	m.Set("e", 503, 1)
+
+	clock.Advance(1 * time.Second)
+
+	isError := func(value interface{}) bool {
+		return value.(int) >= 400
+	}
+	s.Require().Equal(2, m.CountIf(isError))
+	s.Require().Equal(4, m.CountIf(func(interface{}) bool { return true }))
+}
+
+func (s *TTLMapSuite) TestEvictionTieBreaker() {
+	m := NewTTLMap(3)
+	for _, key := range []string{"c", "a", "b"} {
+		m.Set(key, key, 10)
+	}
+	m.Set("d", "d", 20)
+	s.Require().Equal(map[string]bool{"a": false, "b": true, "c": true, "d": true},
+		m.ContainsAll([]string{"a", "b", "c", "d"}))
+
+	m = NewTTLMap(3, WithEvictionTieBreaker(func(a, b Entry) bool {
+		return a.Value.(int) > b.Value.(int)
+	}))
+	m.Set("a", 2, 10)
+	m.Set("b", 3, 10)
+	m.Set("c", 1, 10)
+	m.Set("d", 4, 20)
+	s.Require().Equal(map[string]bool{"a": true, "b": false, "c": true, "d": true},
+		m.ContainsAll([]string{"a", "b", "c", "d"}))
+}
+
+func (s *TTLMapSuite) TestReset() {
+	var evicted []string
+	m := newTTLMap(2, clockwork.NewFakeClock(), WithOnEvict(func(key string, _ interface{}, _ Reason) {
+		evicted = append(evicted, key)
+	}))
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 10)
+	m.Get("a")
+	m.Get("c")
+
+	clock := clockwork.NewFakeClockAt(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC))
+	m.Reset(3, clock)
+	s.Require().Equal(0, m.Len())
+	s.Require().Equal(Stats{}, m.Stats())
+	s.Require().Empty(evicted)
+
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 10)
+	m.Set("c", 3, 10)
+	m.Set("d", 4, 20)
+	s.Require().Equal(3, m.Len())
+	s.Require().Equal([]string{"a"}, evicted)
+
+	ok, err := m.CheckTTL("d", 20*time.Second, 20*time.Second)
+	s.Require().NoError(err)
+	s.Require().Equal(true, ok)
+}
+
+func (s *TTLMapSuite) TestTTLUntil() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1, clock)
+
+	ttl, err := m.TTLUntil(clock.Now().Add(10 * time.Second))
+	s.Require().NoError(err)
+	s.Require().Equal(10, ttl)
+
+	ttl, err = m.TTLUntil(clock.Now().Add(10*time.Second + time.Millisecond))
+	s.Require().NoError(err)
+	s.Require().Equal(11, ttl)
+
+	_, err = m.TTLUntil(clock.Now().Add(-time.Second))
+	s.Require().Error(err)
+	_, err = m.TTLUntil(clock.Now())
+	s.Require().Error(err)
+}
+
+func (s *TTLMapSuite) TestNewTTLMapChecked() {
+	_, err := NewTTLMapChecked(-1)
+	s.Require().Error(err)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	m, err := NewTTLMapChecked(1 << 40)
+	s.Require().NoError(err)
+	runtime.ReadMemStats(&after)
+	s.Require().Less(after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	m.Set("a", 1, 10)
+	s.Require().Equal(1, m.Len())
+}
+
+func (s *TTLMapSuite) TestIncrementWindow() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1, clock)
+	resetsAt := clock.Now().Add(10 * time.Second)
+
+	count, at, err := m.IncrementWindow("a", 1, 10)
+	s.Require().NoError(err)
+	s.Require().Equal(1, count)
+	s.Require().Equal(resetsAt.Unix(), at.Unix())
+
+	clock.Advance(5 * time.Second)
+	count, at, err = m.IncrementWindow("a", 2, 10)
+	s.Require().NoError(err)
+	s.Require().Equal(3, count)
+	s.Require().Equal(resetsAt.Unix(), at.Unix())
+
+	clock.Advance(5 * time.Second)
+	count, at, err = m.IncrementWindow("a", 1, 10)
+	s.Require().NoError(err)
+	s.Require().Equal(1, count)
+	s.Require().Equal(clock.Now().Add(10*time.Second).Unix(), at.Unix())
+
+	m.Set("b", "b", 10)
+	_, _, err = m.IncrementWindow("b", 1, 10)
+	s.Require().Error(err)
+}
+
+func (s *TTLMapSuite) TestWouldEvict() {
+	m := newTTLMap(3, clockwork.NewFakeClock())
+	m.Set("a", 1, 30)
+	m.Set("b", 2, 10)
+
+	will, victim := m.WouldEvict("c")
+	s.Require().Equal(false, will)
+	s.Require().Equal("", victim)
+
+	m.Set("c", 3, 20)
+	will, victim = m.WouldEvict("d")
+	s.Require().Equal(true, will)
+	s.Require().Equal("b", victim)
+	s.Require().Equal(3, m.Len())
+
+	will, _ = m.WouldEvict("a")
+	s.Require().Equal(false, will)
+
+	m.Set("d", 4, 30)
+	_, exists := m.Get(victim)
+	s.Require().Equal(false, exists)
+}
+
+func (s *TTLMapSuite) TestUpdateAll() {
+	clock := clockwork.NewFakeClock()
+	evicted := make(map[string]Reason)
+	m := newTTLMap(10, clock, WithOnEvict(func(key string, _ interface{}, reason Reason) {
+		evicted[key] = reason
+	}))
+	m.Set("a", 10, 10)
+	m.Set("b", 1, 20)
+	m.Set("c", 20, 30)
+
+	m.UpdateAll(func(key string, value interface{}) (interface{}, bool) {
+		decayed := value.(int) * 9 / 10
+		return decayed, decayed > 0
+	})
+
+	s.Require().Equal(map[string]Reason{"b": ReasonDeleted}, evicted)
+	s.Require().Equal(2, m.Len())
+	entries := m.EntriesWithTTL()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	s.Require().Equal([]EntryWithTTL{
+		{Key: "a", Value: 9, TTL: 10 * time.Second},
+		{Key: "c", Value: 18, TTL: 30 * time.Second},
+	}, entries)
+}
+
+func (s *TTLMapSuite) TestMoveTo() {
+	clock := clockwork.NewFakeClock()
+	src := newTTLMap(10, clock)
+	dst := newTTLMap(10, clock)
+	src.Set("a", 1, 30)
+	src.Set("b", 2, 1)
+	clock.Advance(10 * time.Second)
+
+	s.Require().Equal(true, src.MoveTo(dst, "a"))
+	s.Require().Equal(0, src.CountIf(func(interface{}) bool { return true }))
+	s.Require().Equal([]EntryWithTTL{{Key: "a", Value: 1, TTL: 20 * time.Second}}, dst.EntriesWithTTL())
+
+	s.Require().Equal(false, src.MoveTo(dst, "a"))
+	s.Require().Equal(false, src.MoveTo(dst, "b"))
+	_, exists := dst.Get("b")
+	s.Require().Equal(false, exists)
+
+	full := newTTLMap(1, clock)
+	full.Set("x", 1, 10)
+	full.Pin("x")
+	s.Require().Equal(false, dst.MoveTo(full, "a"))
+	s.Require().Equal([]EntryWithTTL{{Key: "a", Value: 1, TTL: 20 * time.Second}}, dst.EntriesWithTTL())
+}
+
+func (s *TTLMapSuite) TestMoveToKeepsEntryState() {
+	clock := clockwork.NewFakeClock()
+	src := newTTLMap(10, clock)
+	dst := newTTLMap(10, clock)
+	c := &testCloser{}
+	s.Require().Equal(nil, src.SetCloser("a", c, 30))
+	src.tag(src.elements["a"], []string{"tag"})
+	src.elements["a"].meta = map[string]string{"owner": "x"}
+	src.Pin("a")
+
+	s.Require().Equal(true, src.MoveTo(dst, "a"))
+	s.Require().Equal(0, c.closed)
+	_, meta, _ := dst.GetWithMetadata("a")
+	s.Require().Equal(map[string]string{"owner": "x"}, meta)
+	s.Require().Equal(1, dst.pinnedCount)
+	s.Require().Equal(0, src.pinnedCount)
+
+	// rejected by a full map the entry goes back as it was
+	full := newTTLMap(1, clock)
+	full.Set("x", 1, 10)
+	full.Pin("x")
+	s.Require().Equal(false, dst.MoveTo(full, "a"))
+	s.Require().Equal(0, c.closed)
+	_, meta, _ = dst.GetWithMetadata("a")
+	s.Require().Equal(map[string]string{"owner": "x"}, meta)
+	s.Require().Equal(1, dst.pinnedCount)
+	s.Require().Equal(1, dst.InvalidateTag("tag"))
+	s.Require().Equal(1, c.closed)
+}
+
+func (s *TTLMapSuite) TestConcurrentAccess() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(20, clock)
+	var expired int64
+	m.SetOnExpire(func(key string, _ interface{}) {
+		atomic.AddInt64(&expired, 1)
+		// Callbacks run outside the lock and may access the map
+		m.Len()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("%d", (i+j)%30)
+				switch j % 5 {
+				case 0:
+					m.Set(key, j, 1+j%3)
+				case 1:
+					m.Get(key)
+				case 2:
+					m.Increment(fmt.Sprintf("counter-%d", j%3), 1, 2)
+				case 3:
+					m.GetInt(key)
+				case 4:
+					m.RemoveExpired(5)
+					m.RemoveLastUsed(1)
+				}
+				if i == 0 && j%10 == 0 {
+					clock.Advance(time.Second)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	clock.Advance(time.Hour)
+	m.RemoveExpired(100)
+	s.Require().Equal(0, m.Len())
+	s.Require().True(atomic.LoadInt64(&expired) > 0)
+}
+
+func (s *TTLMapSuite) TestEvictionHysteresis() {
+	m := newTTLMap(100, clockwork.NewFakeClock(), WithEvictionHysteresis(3, 5))
+	for i := 0; i < 5; i++ {
+		m.Set(fmt.Sprintf("%d", i), i, 10+i)
+	}
+	s.Require().Equal(5, m.Len())
+
+	m.Set("5", 5, 20)
+	s.Require().Equal(3, m.Len())
+	s.Require().Equal(map[string]bool{"0": false, "1": false, "2": false, "3": true, "4": true, "5": true},
+		m.ContainsAll([]string{"0", "1", "2", "3", "4", "5"}))
+
+	m.Set("6", 6, 20)
+	m.Set("7", 7, 20)
+	s.Require().Equal(5, m.Len())
+	s.Require().Equal(int64(3), m.Stats().CapacityEvictions)
+
+	m.Set("8", 8, 20)
+	s.Require().Equal(3, m.Len())
+}
+
+// BenchmarkNewTTLMap measures the memory taken by an empty map
+func BenchmarkNewTTLMap(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewTTLMap(1)
+	}
+}
+
+// BenchmarkRemoveExpired sweeps maps of 100k entries of which only some
+// have expired, the sweep cost grows with the expired entries only
+func BenchmarkRemoveExpired(b *testing.B) {
+	const size = 100000
+	for _, expired := range []int{10, 1000, size} {
+		b.Run(fmt.Sprintf("%d of %d expired", expired, size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				clock := clockwork.NewFakeClock()
+				m := newTTLMap(size, clock)
+				for j := 0; j < size; j++ {
+					ttl := 60
+					if j < expired {
+						ttl = 1
+					}
+					m.Set(fmt.Sprintf("%d", j), j, ttl)
+				}
+				clock.Advance(time.Second)
+				b.StartTimer()
+
+				if removed := m.RemoveExpired(size); removed != expired {
+					b.Fatalf("removed %d entries, expected %d", removed, expired)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEvictionHysteresis(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "one in one out"},
+		{name: "hysteresis", opts: []Option{WithEvictionHysteresis(900, 1000)}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			m := NewTTLMap(1000, bench.opts...)
+			waves := 0
+			for i := 0; i < b.N; i++ {
+				before := m.Stats().CapacityEvictions
+				m.Set(fmt.Sprintf("%d", i), i, 60)
+				if m.Stats().CapacityEvictions > before {
+					waves += 1
+				}
+			}
+			b.ReportMetric(float64(waves)/float64(b.N), "eviction-waves/op")
+		})
+	}
+}
+
+func (s *TTLMapSuite) TestGetAndDelete() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock)
+	var expired []string
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired = append(expired, key)
+	})
+	m.Set("token", "secret", 10)
+	m.Set("stale", "old", 1)
+	clock.Advance(time.Second)
+
+	value, ok := m.GetAndDelete("token")
+	s.Require().Equal(true, ok)
+	s.Require().Equal("secret", value)
+	value, ok = m.GetAndDelete("token")
+	s.Require().Equal(false, ok)
+	s.Require().Equal(nil, value)
+	_, ok = m.GetAndDelete("stale")
+	s.Require().Equal(false, ok)
+	s.Require().Equal(0, m.RawLen())
+	s.Require().Equal([]string{"stale"}, expired)
+}
+
+func (s *TTLMapSuite) TestGetAndDeleteConcurrent() {
+	m := NewTTLMap(10)
+	m.Set("token", "secret", 10)
+
+	var wg sync.WaitGroup
+	var consumed int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, ok := m.GetAndDelete("token"); ok && value == "secret" {
+				atomic.AddInt64(&consumed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	s.Require().Equal(int64(1), consumed)
+	s.Require().Equal(0, m.Len())
+}
+
+func (s *TTLMapSuite) TestTouch() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock)
+	m.Set("a", 1, 5)
+	m.Set("b", 2, 10)
+
+	clock.Advance(4 * time.Second)
+	touched, err := m.Touch("a", 20)
+	s.Require().NoError(err)
+	s.Require().Equal(true, touched)
+
+	clock.Advance(2 * time.Second)
+	s.Require().Equal(0, m.RemoveExpired(10))
+	value, exists := m.Get("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(1, value)
+
+	m.Set("c", 3, 30)
+	_, exists = m.Get("b")
+	s.Require().Equal(false, exists)
+
+	touched, err = m.Touch("missing", 10)
+	s.Require().NoError(err)
+	s.Require().Equal(false, touched)
+
+	_, err = m.Touch("a", 0)
+	s.Require().Error(err)
+
+	clock.Advance(20 * time.Second)
+	touched, err = m.Touch("a", 10)
+	s.Require().NoError(err)
+	s.Require().Equal(false, touched)
+}
+
+func (s *TTLMapSuite) TestRemove() {
+	clock := clockwork.NewFakeClock()
+	var expired []string
+	m := newTTLMap(3, clock)
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired = append(expired, key)
+	})
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 1)
+	m.Set("c", 3, 20)
+
+	value, exists := m.Remove("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(1, value)
+	s.Require().Equal(2, m.Len())
+	_, exists = m.Get("a")
+	s.Require().Equal(false, exists)
+	s.Require().Empty(expired)
+
+	value, exists = m.Remove("a")
+	s.Require().Equal(false, exists)
+	s.Require().Nil(value)
+
+	clock.Advance(time.Second)
+	_, exists = m.Remove("b")
+	s.Require().Equal(false, exists)
+	s.Require().Equal([]string{"b"}, expired)
+
+	clock.Advance(time.Minute)
+	s.Require().Equal(1, m.RemoveExpired(10))
+	s.Require().Equal(0, m.Len())
+}
+
+func (s *TTLMapSuite) TestRange() {
+	clock := clockwork.NewFakeClock()
+	var expired []string
+	m := newTTLMap(10, clock)
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired = append(expired, key)
+	})
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 1)
+	m.Set("c", 3, 10)
+	clock.Advance(time.Second)
+
+	seen := make(map[string]interface{})
+	m.Range(func(key string, value interface{}) bool {
+		seen[key] = value
+		return true
+	})
+	s.Require().Equal(map[string]interface{}{"a": 1, "c": 3}, seen)
+	s.Require().Equal([]string{"b"}, expired)
+	s.Require().Equal(2, m.Len())
+
+	calls := 0
+	m.Range(func(key string, value interface{}) bool {
+		calls += 1
+		m.Remove(key)
+		return false
+	})
+	s.Require().Equal(1, calls)
+	s.Require().Equal(1, m.Len())
+}
+
+func (s *TTLMapSuite) TestKeys() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(3, clock)
+	s.Require().Empty(m.Keys())
+
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 1)
+	m.Set("c", 3, 10)
+	m.Set("a", 4, 10)
+	// the map is full, b is evicted being closest to its expiry
+	m.Set("d", 5, 10)
+	clock.Advance(time.Second)
+
+	keys := m.Keys()
+	sort.Strings(keys)
+	s.Require().Equal([]string{"a", "c", "d"}, keys)
+}
+
+func (s *TTLMapSuite) TestClear() {
+	clock := clockwork.NewFakeClock()
+	var expired []string
+	m := newTTLMap(2, clock)
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired = append(expired, key)
+	})
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 1)
+	clock.Advance(time.Second)
+
+	m.Clear()
+	s.Require().Equal(0, m.Len())
+	s.Require().Empty(expired)
+
+	m.Set("c", 3, 10)
+	m.Set("d", 4, 20)
+	m.Set("e", 5, 20)
+	s.Require().Equal(2, m.Len())
+	s.Require().Equal(map[string]bool{"c": false, "d": true, "e": true},
+		m.ContainsAll([]string{"c", "d", "e"}))
+
+	m.Set("f", 6, 1)
+	clock.Advance(time.Second)
+	m.RemoveExpired(10)
+	s.Require().Equal([]string{"f"}, expired)
+}
+
+func (s *TTLMapSuite) TestOnEvictReasons() {
+	clock := clockwork.NewFakeClock()
+	evicted := make(map[string]Reason)
+	var expired []string
+	m := newTTLMap(2, clock, WithOnEvict(func(key string, _ interface{}, reason Reason) {
+		evicted[key] = reason
+	}))
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired = append(expired, key)
+	})
+
+	m.Set("expired", 1, 1)
+	m.Set("deleted", 2, 20)
+	clock.Advance(time.Second)
+	m.RemoveExpired(1)
+	m.Remove("deleted")
+
+	m.Set("capacity", 3, 10)
+	m.Set("kept", 4, 20)
+	m.RemoveLastUsed(1)
+
+	s.Require().Equal(map[string]Reason{
+		"expired":  ReasonExpired,
+		"deleted":  ReasonDeleted,
+		"capacity": ReasonCapacity,
+	}, evicted)
+	s.Require().Equal([]string{"expired"}, expired)
+	s.Require().Equal("capacity", ReasonCapacity.String())
+}
+
+func (s *TTLMapSuite) TestSetCapacity() {
+	clock := clockwork.NewFakeClock()
+	evicted := make(map[string]Reason)
+	m := newTTLMap(4, clock, WithOnEvict(func(key string, _ interface{}, reason Reason) {
+		evicted[key] = reason
+	}))
+	m.Set("a", 1, 40)
+	m.Set("b", 2, 10)
+	m.Set("c", 3, 30)
+	m.Set("d", 4, 20)
+
+	s.Require().Error(m.SetCapacity(0))
+	s.Require().Equal(nil, m.SetCapacity(2))
+	s.Require().Equal(2, m.Len())
+	s.Require().Equal(map[string]Reason{"b": ReasonCapacity, "d": ReasonCapacity}, evicted)
+
+	s.Require().Equal(nil, m.SetCapacity(3))
+	s.Require().Equal(2, m.Len())
+	m.Set("e", 5, 50)
+	s.Require().Equal(3, m.Len())
+	s.Require().Equal(2, len(evicted))
+}
+
+func (s *TTLMapSuite) TestPeek() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock)
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 20)
+
+	for i := 0; i < 10; i++ {
+		value, exists := m.Peek("a")
+		s.Require().Equal(true, exists)
+		s.Require().Equal(1, value)
+	}
+	s.Require().Equal(Stats{}, m.Stats())
+
+	m.Set("c", 3, 30)
+	_, exists := m.Peek("a")
+	s.Require().Equal(false, exists)
+
+	clock.Advance(20 * time.Second)
+	_, exists = m.Peek("b")
+	s.Require().Equal(false, exists)
+	s.Require().Equal(2, m.RawLen())
+}
+
+func (s *TTLMapSuite) TestGetOrSet() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+
+	actual, loaded, err := m.GetOrSet("a", 1, 1)
+	s.Require().NoError(err)
+	s.Require().Equal(false, loaded)
+	s.Require().Equal(1, actual)
+
+	actual, loaded, err = m.GetOrSet("a", 2, 1)
+	s.Require().NoError(err)
+	s.Require().Equal(true, loaded)
+	s.Require().Equal(1, actual)
+
+	clock.Advance(time.Second)
+	actual, loaded, err = m.GetOrSet("a", 3, 1)
+	s.Require().NoError(err)
+	s.Require().Equal(false, loaded)
+	s.Require().Equal(3, actual)
+
+	_, _, err = m.GetOrSet("b", 1, 0)
+	s.Require().Error(err)
+
+	var wg sync.WaitGroup
+	var stored int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, loaded, _ := m.GetOrSet("c", i, 10); !loaded {
+				atomic.AddInt64(&stored, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.Require().Equal(int64(1), stored)
+}
+
+func (s *TTLMapSuite) TestDecrement() {
+	m := newTTLMap(10, clockwork.NewFakeClock())
+
+	count, err := m.Increment("a", 5, 10)
+	s.Require().NoError(err)
+	s.Require().Equal(5, count)
+
+	count, existed, err := m.Decrement("a", 3, 10)
+	s.Require().NoError(err)
+	s.Require().Equal(true, existed)
+	s.Require().Equal(2, count)
+
+	count, existed, err = m.Decrement("b", 3, 10)
+	s.Require().NoError(err)
+	s.Require().Equal(false, existed)
+	s.Require().Equal(-3, count)
+
+	m.Set("c", "c", 10)
+	_, _, err = m.Decrement("c", 1, 10)
+	s.Require().EqualError(err, "Expected existing value to be integer, got string")
+
+	_, _, err = m.Decrement("a", 1, 0)
+	s.Require().Error(err)
+}
+
+func (s *TTLMapSuite) TestSetIfAbsent() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+
+	set, err := m.SetIfAbsent("a", 1, 1)
+	s.Require().NoError(err)
+	s.Require().Equal(true, set)
+
+	set, err = m.SetIfAbsent("a", 2, 1)
+	s.Require().NoError(err)
+	s.Require().Equal(false, set)
+	value, _ := m.Get("a")
+	s.Require().Equal(1, value)
+
+	clock.Advance(time.Second)
+	set, err = m.SetIfAbsent("a", 3, 1)
+	s.Require().NoError(err)
+	s.Require().Equal(true, set)
+
+	_, err = m.SetIfAbsent("b", 1, 0)
+	s.Require().Error(err)
+
+	var wg sync.WaitGroup
+	var winners int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if set, _ := m.SetIfAbsent("lock", i, 10); set {
+				atomic.AddInt64(&winners, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.Require().Equal(int64(1), winners)
+}
+
+func (s *TTLMapSuite) TestGetWithTTL() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+	m.Set("a", 1, 10)
+
+	clock.Advance(3 * time.Second)
+	value, ttl, exists := m.GetWithTTL("a")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(1, value)
+	s.Require().Equal(7*time.Second, ttl)
+
+	clock.Advance(7 * time.Second)
+	value, ttl, exists = m.GetWithTTL("a")
+	s.Require().Equal(false, exists)
+	s.Require().Nil(value)
+	s.Require().Equal(time.Duration(0), ttl)
+	s.Require().Equal(0, m.Len())
+
+	_, _, exists = m.GetWithTTL("missing")
+	s.Require().Equal(false, exists)
+}
+
+func (s *TTLMapSuite) TestSlidingExpiration() {
+	clock := clockwork.NewFakeClock()
+	sliding := newTTLMap(10, clock, WithSlidingExpiration())
+	absolute := newTTLMap(10, clock)
+	sliding.Set("a", 1, 5)
+	absolute.Set("a", 1, 5)
+
+	for i := 0; i < 5; i++ {
+		clock.Advance(4 * time.Second)
+		_, exists := sliding.Get("a")
+		s.Require().Equal(true, exists)
+		_, _, err := sliding.GetInt("a")
+		s.Require().NoError(err)
+	}
+	_, exists := absolute.Get("a")
+	s.Require().Equal(false, exists)
+
+	ok, err := sliding.CheckTTL("a", 5*time.Second, 5*time.Second)
+	s.Require().NoError(err)
+	s.Require().Equal(true, ok)
+
+	clock.Advance(5 * time.Second)
+	_, exists = sliding.Get("a")
+	s.Require().Equal(false, exists)
+}
+
+func (s *TTLMapSuite) TestSetDefault() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock, WithDefaultTTL(30))
+
+	s.Require().Equal(nil, m.SetDefault("a", 1))
+	s.Require().Equal(nil, m.Set("b", 2, 10))
+	ok, err := m.CheckTTL("a", 30*time.Second, 30*time.Second)
+	s.Require().NoError(err)
+	s.Require().Equal(true, ok)
+
+	clock.Advance(10 * time.Second)
+	_, exists := m.Get("b")
+	s.Require().Equal(false, exists)
+	_, exists = m.Get("a")
+	s.Require().Equal(true, exists)
+
+	err = NewTTLMap(10).SetDefault("a", 1)
+	s.Require().EqualError(err, "no default TTL is configured")
+}
+
+func (s *TTLMapSuite) TestNoExpiry() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(2, clock, WithNoExpiry())
+
+	s.Require().Equal(nil, m.Set("table", 1, 0))
+	s.Require().Error(m.Set("negative", 1, -1))
+	s.Require().Error(newTTLMap(2, clock).Set("table", 1, 0))
+
+	clock.Advance(24 * 365 * time.Hour)
+	s.Require().Equal(0, m.RemoveExpired(10))
+	value, ttl, exists := m.GetWithTTL("table")
+	s.Require().Equal(true, exists)
+	s.Require().Equal(1, value)
+	s.Require().Equal(time.Duration(0), ttl)
+
+	m.Set("a", 2, 10)
+	m.Set("b", 3, 10)
+	s.Require().Equal(map[string]bool{"table": true, "a": false, "b": true},
+		m.ContainsAll([]string{"table", "a", "b"}))
+
+	m.Remove("b")
+	m.Set("other", 4, 0)
+	m.Set("c", 5, 10)
+	s.Require().Equal(map[string]bool{"table": true, "other": false, "c": true},
+		m.ContainsAll([]string{"table", "other", "c"}))
+}
+
+func (s *TTLMapSuite) TestValues() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+	s.Require().Empty(m.Values())
+
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 1)
+	m.Set("c", 3, 1)
+	m.Set("d", 4, 10)
+	clock.Advance(time.Second)
+
+	values := m.Values()
+	s.Require().ElementsMatch([]interface{}{1, 4}, values)
+	s.Require().Equal(len(values), m.Len())
+}
+
+func (s *TTLMapSuite) TestLenExcludesExpired() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+	m.Set("a", 1, 1)
+	m.Set("b", 2, 10)
+	clock.Advance(time.Second)
+
+	s.Require().Equal(1, m.Len())
+	s.Require().Equal(2, m.RawLen())
+
+	for i := 0; i < 5; i++ {
+		m.Set(fmt.Sprintf("%d", i), i, 1+i)
+	}
+	clock.Advance(3 * time.Second)
+	s.Require().Equal(3, m.Len())
+	s.Require().Equal(7, m.RawLen())
+}
+
+func (s *TTLMapSuite) TestString() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+	s.Require().Equal("ttlmap(len=0/cap=10){}", m.String())
+
+	m.Set("b", 2, 10)
+	m.Set("a", 1, 5)
+	m.Set("c", "x", 1)
+	clock.Advance(2 * time.Second)
+
+	s.Require().Equal("ttlmap(len=2/cap=10){a=1(ttl=3s) b=2(ttl=8s)}", m.String())
+	s.Require().Equal(map[string]interface{}{"a": 1, "b": 2}, m.Dump())
+}
+
+func (s *TTLMapSuite) TestMSet() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(3, clock)
+	m.Set("old", 0, 25)
+
+	err := m.MSet([]Entry{
+		{Key: "a", Value: 1, TTLSeconds: 10},
+		{Key: "b", Value: 2, TTLSeconds: 40},
+		{Key: "c", Value: 3, TTLSeconds: 20},
+		{Key: "d", Value: 4, TTLSeconds: 30},
+		{Key: "a", Value: 5, TTLSeconds: 50},
+	})
+	s.Require().NoError(err)
+	s.Require().Equal(3, m.Len())
+	s.Require().Equal(map[string]interface{}{"a": 5, "b": 2, "d": 4}, m.Dump())
+	s.Require().Equal(int64(2), m.Stats().CapacityEvictions)
+
+	err = m.MSet([]Entry{
+		{Key: "e", Value: 6, TTLSeconds: 100},
+		{Key: "f", Value: 7, TTLSeconds: 0},
+	})
+	s.Require().True(errors.Is(err, ErrInvalidTTL))
+	_, exists := m.Get("e")
+	s.Require().Equal(false, exists)
+}
+
+func (s *TTLMapSuite) TestGetMulti() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock)
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 1)
+	m.Set("c", 3, 10)
+	clock.Advance(time.Second)
+
+	s.Require().Equal(map[string]interface{}{"a": 1, "c": 3},
+		m.GetMulti([]string{"a", "b", "c", "missing"}))
+	s.Require().Equal(2, m.RawLen())
+	s.Require().Equal(Stats{Hits: 2, Misses: 2, Expirations: 1}, m.Stats())
+	s.Require().Empty(m.GetMulti(nil))
+}
+
+func (s *TTLMapSuite) TestRemovePrefix() {
+	clock := clockwork.NewFakeClock()
+	var expired []string
+	m := newTTLMap(10, clock)
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired = append(expired, key)
+	})
+	m.Set("user:1:session", 1, 10)
+	m.Set("user:1:profile", 2, 10)
+	m.Set("user:1:stale", 3, 1)
+	m.Set("user:12:session", 4, 10)
+	m.Set("user:2:session", 5, 10)
+	clock.Advance(time.Second)
+
+	s.Require().Equal(2, m.RemovePrefix("user:1:"))
+	keys := m.Keys()
+	sort.Strings(keys)
+	s.Require().Equal([]string{"user:12:session", "user:2:session"}, keys)
+	s.Require().Equal(2, m.RawLen())
+	s.Require().Equal([]string{"user:1:stale"}, expired)
+
+	s.Require().Equal(0, m.RemovePrefix("group:"))
+}
+
+func (s *TTLMapSuite) TestWithClock() {
+	clock := clockwork.NewFakeClock()
+	m := NewTTLMap(10, WithClock(clock))
+
+	s.Require().Equal(nil, m.Set("a", 1, 2))
+	clock.Advance(time.Second)
+	value, ok := m.Get("a")
+	s.Require().Equal(true, ok)
+	s.Require().Equal(1, value)
+
+	clock.Advance(time.Second)
+	_, ok = m.Get("a")
+	s.Require().Equal(false, ok)
+}
+
+func (s *TTLMapSuite) TestOptionsCompose() {
+	clock := clockwork.NewFakeClock()
+	evicted := make(map[string]Reason)
+	m := NewTTLMap(2,
+		WithClock(clock),
+		WithSlidingExpiration(),
+		WithEvictionPolicy(PolicyLFU),
+		WithOnEvict(func(key string, _ interface{}, reason Reason) {
+			evicted[key] = reason
+		}))
+
+	m.Set("a", 1, 2)
+	m.Set("b", 2, 5)
+	clock.Advance(time.Second)
+	// reading a slides its expiry and makes it the most frequently used,
+	// so b is evicted despite a expiring sooner
+	_, exists := m.Get("a")
+	s.Require().Equal(true, exists)
+
+	m.Set("c", 3, 10)
+	s.Require().Equal(map[string]Reason{"b": ReasonCapacity}, evicted)
+
+	clock.Advance(time.Second)
+	_, exists = m.Get("a")
+	s.Require().Equal(true, exists)
+	clock.Advance(2 * time.Second)
+	_, exists = m.Get("a")
+	s.Require().Equal(false, exists)
+	s.Require().Equal(map[string]Reason{"a": ReasonExpired, "b": ReasonCapacity}, evicted)
+}
+
+func (s *TTLMapSuite) TestRangeByExpiry() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(10, clock, WithNoExpiry())
+	m.Set("never", 0, 0)
+	m.Set("three", 3, 3)
+	m.Set("one", 1, 1)
+	m.Set("two", 2, 2)
+	m.Set("expired", 4, 1)
+	clock.Advance(time.Second)
+	m.Set("one", 1, 1)
+
+	var keys []string
+	var ttls []time.Duration
+	m.RangeByExpiry(func(key string, value interface{}, expiresAt time.Time) bool {
+		keys = append(keys, key)
+		if expiresAt.IsZero() {
+			ttls = append(ttls, 0)
+		} else {
+			ttls = append(ttls, expiresAt.Sub(clock.Now()))
+		}
+		return true
+	})
+	s.Require().Equal([]string{"one", "two", "three", "never"}, keys)
+	s.Require().Equal([]time.Duration{time.Second, time.Second, 2 * time.Second, 0}, ttls)
+	s.Require().Equal(4, m.RawLen())
+
+	keys = nil
+	m.RangeByExpiry(func(key string, value interface{}, expiresAt time.Time) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	s.Require().Equal([]string{"one", "two"}, keys)
+}
+
+func (s *TTLMapSuite) TestPopExpired() {
+	clock := clockwork.NewFakeClock()
+	var expired []string
+	m := newTTLMap(10, clock)
+	m.SetOnExpire(func(key string, _ interface{}) {
+		expired = append(expired, key)
+	})
+	s.Require().Empty(m.PopExpired())
+
+	start := clock.Now()
+	m.Set("a", 1, 2)
+	m.Set("b", 2, 1)
+	m.Set("c", 3, 3)
+	m.Set("d", 4, 4)
+	m.Set("e", 5, 5)
+	clock.Advance(3 * time.Second)
+
+	popped := m.PopExpired()
+	s.Require().Len(popped, 3)
+	for i, expected := range []struct {
+		key   string
+		value int
+		ttl   time.Duration
+	}{{"b", 2, time.Second}, {"a", 1, 2 * time.Second}, {"c", 3, 3 * time.Second}} {
+		s.Require().Equal(expected.key, popped[i].Key)
+		s.Require().Equal(expected.value, popped[i].Value)
+		s.Require().Equal(expected.ttl, popped[i].ExpiredAt.Sub(start))
+	}
+	s.Require().Empty(expired)
+	s.Require().Equal(2, m.RawLen())
+	s.Require().Equal(int64(3), m.Stats().Expirations)
+	s.Require().Empty(m.PopExpired())
+}
+
+func (s *TTLMapSuite) TestMerge() {
+	clock := clockwork.NewFakeClock()
+	newMaps := func() (*TTLMap, *TTLMap) {
+		dst := newTTLMap(3, clock)
+		dst.Set("a", "dst a", 10)
+		dst.Set("b", "dst b", 20)
+		dst.Set("expired", "dst expired", 1)
+		src := newTTLMap(10, clock)
+		src.Set("b", "src b", 5)
+		src.Set("c", "src c", 30)
+		src.Set("expired", "src expired", 15)
+		return dst, src
+	}
+
+	dst, src := newMaps()
+	clock.Advance(time.Second)
+	s.Require().Equal(nil, dst.Merge(src, false))
+	s.Require().Equal(map[string]interface{}{"b": "dst b", "c": "src c", "expired": "src expired"}, dst.Dump())
+	_, ttl, _ := dst.GetWithTTL("expired")
+	s.Require().Equal(14*time.Second, ttl)
+	s.Require().Equal(3, src.Len())
+
+	dst, src = newMaps()
+	clock.Advance(time.Second)
+	s.Require().Equal(nil, dst.Merge(src, true))
+	// b from src replaced b and then was evicted being closest to expiry
+	s.Require().Equal(map[string]interface{}{"a": "dst a", "c": "src c", "expired": "src expired"}, dst.Dump())
+	_, ttl, _ = dst.GetWithTTL("c")
+	s.Require().Equal(29*time.Second, ttl)
+
+	s.Require().Equal(nil, dst.Merge(dst, true))
+	s.Require().Equal(3, dst.Len())
+}
+
+func (s *TTLMapSuite) TestSwap() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(3, clock)
+
+	previous, had, err := m.Swap("a", 1, 2)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(false, had)
+	s.Require().Equal(nil, previous)
+
+	previous, had, err = m.Swap("a", 2, 2)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(true, had)
+	s.Require().Equal(1, previous)
+	value, _ := m.Get("a")
+	s.Require().Equal(2, value)
+
+	clock.Advance(2 * time.Second)
+	previous, had, err = m.Swap("a", 3, 2)
+	s.Require().Equal(nil, err)
+	s.Require().Equal(false, had)
+	s.Require().Equal(nil, previous)
+
+	_, _, err = m.Swap("a", 4, -1)
+	s.Require().Error(err)
+	value, _ = m.Get("a")
+	s.Require().Equal(3, value)
+}
+
+func (s *TTLMapSuite) TestTTLJitter() {
+	clock := clockwork.NewFakeClock()
+	m := newTTLMap(1000, clock, WithTTLJitter(0.1), WithRandSource(rand.NewSource(1)))
+
+	ttls := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+		s.Require().Equal(nil, m.Set(key, i, 100))
+		_, ttl, _ := m.GetWithTTL(key)
+		s.Require().True(ttl >= 90*time.Second && ttl <= 110*time.Second, "%v is out of the window", ttl)
+		ttls[ttl] = true
+	}
+	s.Require().True(len(ttls) > 1)
+
+	// short TTLs are kept at a second at least
+	s.Require().Equal(nil, m.Set("short", 1, 1))
+	_, ttl, _ := m.GetWithTTL("short")
+	s.Require().Equal(time.Second, ttl)
+
+	m = newTTLMap(10, clock)
+	m.Set("a", 1, 100)
+	_, ttl, _ = m.GetWithTTL("a")
+	s.Require().Equal(100*time.Second, ttl)
+}
+
+func newTTLMap(ttlSeconds int, clock clockwork.FakeClock, opts ...Option) *TTLMap {
+	return NewTTLMap(ttlSeconds, append([]Option{WithClock(clock)}, opts...)...)
 }
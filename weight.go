@@ -0,0 +1,64 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"fmt"
+)
+
+// WithMaxWeight limits the total weight of the entries in the map,
+// evicting entries on insert until both the weight and the entries count
+// limits are met. Entries are weighted with SetWithWeight, entries stored
+// otherwise weigh nothing. It shares the limit with WithMaxCost, so only
+// one of them should be used.
+func WithMaxWeight(max int) Option {
+	return func(m *TTLMap) {
+		m.maxCost = max
+	}
+}
+
+// SetWithWeight is like Set but stores the entry with the given weight
+// counted against the WithMaxWeight limit instead of its cost. Values
+// weighing more than the limit are rejected with ErrValueTooLarge. The
+// weight is kept when the value is replaced by UpdateAll.
+func (m *TTLMap) SetWithWeight(key string, value interface{}, ttlSeconds, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("weight should be >= 0, got %d", weight)
+	}
+	expiryTime, err := m.toEpochSeconds(ttlSeconds)
+	if err != nil {
+		return err
+	}
+	value, err = m.prepareValue(value)
+	if err != nil {
+		return err
+	}
+	m.lock()
+	defer m.unlock()
+	if err := m.insert(key, value, expiryTime, weight, true); err != nil {
+		return err
+	}
+	m.elements[key].weighted = true
+	return nil
+}
+
+// Weight returns the total weight of the entries in the map, including
+// expired entries that have not been removed yet
+func (m *TTLMap) Weight() int {
+	m.rLock()
+	defer m.rUnlock()
+	return m.totalCost
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2017 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ttlmap
+
+import (
+	"github.com/jonboulle/clockwork"
+)
+
+func (s *TTLMapSuite) TestSetWithWeight() {
+	m := newTTLMap(10, clockwork.NewFakeClock(), WithMaxWeight(100))
+
+	s.Require().Equal(nil, m.SetWithWeight("light1", 1, 10, 10))
+	s.Require().Equal(nil, m.SetWithWeight("heavy1", []byte("h1"), 20, 60))
+	s.Require().Equal(nil, m.SetWithWeight("light2", 2, 30, 10))
+	s.Require().Equal(nil, m.Set("free", 3, 5))
+	s.Require().Equal(80, m.Weight())
+	s.Require().Equal(4, m.Len())
+
+	// the entries closest to expiry are evicted until heavy2 fits
+	s.Require().Equal(nil, m.SetWithWeight("heavy2", []byte("h2"), 40, 50))
+	s.Require().Equal(map[string]bool{"free": false, "light1": false, "heavy1": false, "light2": true, "heavy2": true},
+		m.ContainsAll([]string{"free", "light1", "heavy1", "light2", "heavy2"}))
+	s.Require().Equal(60, m.Weight())
+	s.Require().Equal(2, m.Len())
+
+	// overwriting replaces the weight
+	s.Require().Equal(nil, m.SetWithWeight("heavy2", []byte("h2"), 40, 5))
+	s.Require().Equal(15, m.Weight())
+
+	s.Require().Equal(ErrValueTooLarge, m.SetWithWeight("huge", 4, 10, 101))
+	s.Require().EqualError(m.SetWithWeight("negative", 4, 10, -1), "weight should be >= 0, got -1")
+	s.Require().Equal(15, m.Weight())
+}
+
+func (s *TTLMapSuite) TestUpdateAllKeepsWeight() {
+	m := newTTLMap(10, clockwork.NewFakeClock(), WithMaxWeight(100))
+	s.Require().Equal(nil, m.SetWithWeight("heavy", 1, 10, 60))
+	s.Require().Equal(nil, m.Set("free", 2, 20))
+
+	m.UpdateAll(func(key string, value interface{}) (interface{}, bool) {
+		return value.(int) * 10, true
+	})
+	s.Require().Equal(60, m.Weight())
+	s.Require().Equal(map[string]interface{}{"heavy": 10, "free": 20}, m.Dump())
+
+	// the budget still holds only one heavy entry
+	s.Require().Equal(nil, m.SetWithWeight("heavy2", 3, 30, 60))
+	s.Require().Equal(60, m.Weight())
+	s.Require().Equal(map[string]interface{}{"heavy2": 3, "free": 20}, m.Dump())
+}